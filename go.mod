@@ -3,10 +3,13 @@ module mylb
 go 1.19
 
 require (
-	github.com/bsm/gomega v1.26.0 // indirect
+	github.com/bsm/gomega v1.26.0
+	github.com/stretchr/testify v1.8.2
+)
+
+require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/stretchr/objx v0.5.0 // indirect
-	github.com/stretchr/testify v1.8.2 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
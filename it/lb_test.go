@@ -177,17 +177,28 @@ func (l *lbTestSuite) TestLoadBalancer_CookiePresents() {
 
 	servers = append(servers, server1.URL, server2.URL, server3.URL)
 
-	pool, _ := lb.NewLoadBalancer(servers, 8000)
+	affinity := lb.WithAffinity(lb.AffinityConfig{Keys: []string{"secret"}})
+	pool, _ := lb.NewLoadBalancer(servers, 8000, affinity)
 	go pool.ListenAndServe()
 
 	time.Sleep(5 * time.Second)
 
+	// another load balancer sharing the key pins the client to server2
+	other, err := lb.New(context.TODO(), []lb.ServerConfig{{URL: server2.URL, Weight: 1}}, affinity)
+	l.NoError(err)
+	defer other.Close()
+
+	w := httptest.NewRecorder()
+	other.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	cookies := w.Result().Cookies()
+	l.Len(cookies, 1)
+	l.NotContains(cookies[0].Value, strings.TrimPrefix(server2.URL, "http://"))
+
 	req, err := http.NewRequest(http.MethodGet, "http://localhost:8000", nil)
 	l.NoError(err)
 
-	// the request coming from a client with cookie that has server2's URL in it
-	cookie := &http.Cookie{Name: "session", Value: server2.URL}
-	req.AddCookie(cookie)
+	// the request coming from a client with the session cookie of server2
+	req.AddCookie(cookies[0])
 
 	// test the round robin hit 1000 times
 	// all the request should be handled by server2
@@ -206,45 +217,31 @@ func (l *lbTestSuite) TestLoadBalancer_CookiePresents() {
 	// now set server2 to down
 	server2.Close()
 
-	// if we dont have cookie the next request should be handled by another running server in circular order
-	// the response should be always be 1, 3, 1, 3, 1, 3 ...
-	client := &http.Client{}
-	res, err := client.Do(req)
-	l.NoError(err)
-	l.Equal(http.StatusOK, res.StatusCode)
-
-	body, _ := ioutil.ReadAll(res.Body)
-	l.Assert().Equal("1", string(body))
-
-	client = &http.Client{}
-	res, err = client.Do(req)
-	l.NoError(err)
-	l.Equal(http.StatusOK, res.StatusCode)
-
-	body, _ = ioutil.ReadAll(res.Body)
-	l.Assert().Equal("3", string(body))
-
-	client = &http.Client{}
-	res, err = client.Do(req)
-	l.NoError(err)
-	l.Equal(http.StatusOK, res.StatusCode)
-
-	body, _ = ioutil.ReadAll(res.Body)
-	l.Assert().Equal("1", string(body))
+	// wait for the health check to mark server2 down
+	time.Sleep(6 * time.Second)
 
-	client = &http.Client{}
-	res, err = client.Do(req)
-	l.NoError(err)
-	l.Equal(http.StatusOK, res.StatusCode)
+	// the session fails over to the same running server on every request
+	// the response should be always be either 1 or 3
+	replacement := ""
+	for i := 0; i < 4; i++ {
+		client := &http.Client{}
+		res, err := client.Do(req)
+		l.NoError(err)
+		l.Equal(http.StatusOK, res.StatusCode)
 
-	body, _ = ioutil.ReadAll(res.Body)
-	l.Assert().Equal("3", string(body))
+		body, _ := ioutil.ReadAll(res.Body)
+		if replacement == "" {
+			replacement = string(body)
+			l.Contains([]string{"1", "3"}, replacement)
+		}
+		l.Assert().Equal(replacement, string(body))
+	}
 
 	pool.Shutdown(context.TODO())
 }
 
 func (l *lbTestSuite) TestLoadBalancer_NoNodesRunning() {
-	servers := []string{"server1.com", "server2.com", "server3.com"}
+	servers := []string{"http://server1.invalid", "http://server2.invalid", "http://server3.invalid"}
 
 	pool, _ := lb.NewLoadBalancer(servers, 8000)
 	go pool.ListenAndServe()
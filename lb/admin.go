@@ -0,0 +1,213 @@
+package lb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// NodeStatus is the state of a node reported by the admin API.
+type NodeStatus struct {
+	URL          string  `json:"url"`
+	Alive        bool    `json:"alive"`
+	Unhealthy    bool    `json:"unhealthy"`
+	Draining     bool    `json:"draining"`
+	Drained      bool    `json:"drained"`
+	Ejected      bool    `json:"ejected"`
+	CircuitState string  `json:"circuit_state"`
+	Weight       float64 `json:"weight"`
+	BaseWeight   float64 `json:"base_weight"`
+	InFlight     int64   `json:"in_flight"`
+}
+
+// Status returns the current state of the node.
+func (n *Node) Status() NodeStatus {
+	return NodeStatus{
+		URL:          n.URL.String(),
+		Alive:        n.IsAlive(),
+		Unhealthy:    n.IsUnhealthy(),
+		Draining:     n.IsDraining(),
+		Drained:      n.IsDrained(),
+		Ejected:      n.IsEjected(),
+		CircuitState: n.CircuitState().String(),
+		Weight:       n.Weight(),
+		BaseWeight:   n.BaseWeight(),
+		InFlight:     n.InFlight(),
+	}
+}
+
+// NewAdminServer creates the admin server of the load balancer, listening on its own port.
+// The API isn't authenticated, so the server only listens on the loopback interface; its
+// Addr can be changed to expose it elsewhere behind a proxy of your own.
+// It exposes the following JSON endpoints, nodes being identified by their url query parameter:
+//
+//	GET    /nodes                   list the nodes and their state
+//	POST   /nodes                   add a node, the body being a server of the server list
+//	DELETE /nodes?url=...           remove a node
+//	PUT    /nodes/weight?url=...    change the weight of a node, e.g. {"weight": 5}
+//	PUT    /nodes/drain?url=...     drain a node or put it back in rotation, e.g. {"draining": true}
+func NewAdminServer(lb *LB, port int) *http.Server {
+	return &http.Server{
+		Addr:    adminAddr(port),
+		Handler: &adminHandler{lb: lb},
+	}
+}
+
+// NewRouterAdminServer creates the admin server of a router, serving the admin API of
+// NewAdminServer for each pool under /pools/<name>, e.g. GET /pools/shop/nodes. Like
+// NewAdminServer, it only listens on the loopback interface.
+func NewRouterAdminServer(rt *Router, port int) *http.Server {
+	mux := http.NewServeMux()
+	for name, lb := range rt.pools {
+		prefix := "/pools/" + name
+		mux.Handle(prefix+"/", http.StripPrefix(prefix, &adminHandler{lb: lb}))
+	}
+
+	return &http.Server{
+		Addr:    adminAddr(port),
+		Handler: mux,
+	}
+}
+
+// adminAddr returns the loopback address of the admin server on port.
+func adminAddr(port int) string {
+	return fmt.Sprintf("127.0.0.1:%d", port)
+}
+
+// adminHandler serves the admin API of a load balancer.
+type adminHandler struct {
+	lb *LB
+}
+
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/nodes":
+		switch r.Method {
+		case http.MethodGet:
+			h.listNodes(w, r)
+		case http.MethodPost:
+			h.addNode(w, r)
+		case http.MethodDelete:
+			h.removeNode(w, r)
+		default:
+			writeMethodNotAllowed(w, http.MethodGet, http.MethodPost, http.MethodDelete)
+		}
+	case "/nodes/weight":
+		if r.Method != http.MethodPut {
+			writeMethodNotAllowed(w, http.MethodPut)
+			return
+		}
+		h.setWeight(w, r)
+	case "/nodes/drain":
+		if r.Method != http.MethodPut {
+			writeMethodNotAllowed(w, http.MethodPut)
+			return
+		}
+		h.setDraining(w, r)
+	default:
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+func (h *adminHandler) listNodes(w http.ResponseWriter, r *http.Request) {
+	statuses := []NodeStatus{}
+	for _, n := range h.lb.nodes() {
+		statuses = append(statuses, n.Status())
+	}
+
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+func (h *adminHandler) addNode(w http.ResponseWriter, r *http.Request) {
+	var server ServerConfig
+	if err := json.NewDecoder(r.Body).Decode(&server); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	n, err := h.lb.AddNode(server)
+	if errors.Is(err, ErrNodeExists) {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, n.Status())
+}
+
+func (h *adminHandler) removeNode(w http.ResponseWriter, r *http.Request) {
+	n, err := h.lb.RemoveNode(r.URL.Query().Get("url"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, n.Status())
+}
+
+func (h *adminHandler) setWeight(w http.ResponseWriter, r *http.Request) {
+	n := h.lb.Node(r.URL.Query().Get("url"))
+	if n == nil {
+		writeError(w, http.StatusNotFound, ErrNodeNotFound)
+		return
+	}
+
+	var body struct {
+		Weight float64 `json:"weight"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if body.Weight <= 0 {
+		writeError(w, http.StatusBadRequest, errors.New("weight must be positive"))
+		return
+	}
+
+	n.SetWeight(body.Weight)
+	writeJSON(w, http.StatusOK, n.Status())
+}
+
+func (h *adminHandler) setDraining(w http.ResponseWriter, r *http.Request) {
+	n := h.lb.Node(r.URL.Query().Get("url"))
+	if n == nil {
+		writeError(w, http.StatusNotFound, ErrNodeNotFound)
+		return
+	}
+
+	var body struct {
+		Draining bool `json:"draining"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	n.SetDraining(body.Draining)
+	writeJSON(w, http.StatusOK, n.Status())
+}
+
+// writeJSON writes v as the JSON body of the response.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes err as the JSON body of the response.
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// writeMethodNotAllowed answers a request whose method isn't supported by the endpoint.
+func writeMethodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	for _, method := range allowed {
+		w.Header().Add("Allow", method)
+	}
+	writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+}
@@ -0,0 +1,229 @@
+package lb
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bsm/gomega"
+)
+
+func newAdminTestLB(t *testing.T) *LB {
+	lb, err := newServerNodes(serverConfigs([]string{"http://localhost:8081", "http://localhost:8082"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lb
+}
+
+func TestAdminHandler(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	testCases := []struct {
+		name           string
+		method         string
+		target         string
+		body           string
+		expectedStatus int
+		expectedURLs   []string
+	}{
+		{
+			name:           "list nodes",
+			method:         http.MethodGet,
+			target:         "/nodes",
+			expectedStatus: http.StatusOK,
+			expectedURLs:   []string{"http://localhost:8081", "http://localhost:8082"},
+		},
+		{
+			name:           "add node",
+			method:         http.MethodPost,
+			target:         "/nodes",
+			body:           `{"url": "http://localhost:8083", "weight": 2}`,
+			expectedStatus: http.StatusCreated,
+			expectedURLs:   []string{"http://localhost:8083", "http://localhost:8081", "http://localhost:8082"},
+		},
+		{
+			name:           "add existing node",
+			method:         http.MethodPost,
+			target:         "/nodes",
+			body:           `"http://localhost:8081"`,
+			expectedStatus: http.StatusConflict,
+			expectedURLs:   []string{"http://localhost:8081", "http://localhost:8082"},
+		},
+		{
+			name:           "add invalid node",
+			method:         http.MethodPost,
+			target:         "/nodes",
+			body:           `{"weight": 2}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedURLs:   []string{"http://localhost:8081", "http://localhost:8082"},
+		},
+		{
+			name:           "remove node",
+			method:         http.MethodDelete,
+			target:         "/nodes?url=http://localhost:8081",
+			expectedStatus: http.StatusOK,
+			expectedURLs:   []string{"http://localhost:8082"},
+		},
+		{
+			name:           "remove unknown node",
+			method:         http.MethodDelete,
+			target:         "/nodes?url=http://localhost:8083",
+			expectedStatus: http.StatusNotFound,
+			expectedURLs:   []string{"http://localhost:8081", "http://localhost:8082"},
+		},
+		{
+			name:           "change weight",
+			method:         http.MethodPut,
+			target:         "/nodes/weight?url=http://localhost:8082",
+			body:           `{"weight": 3}`,
+			expectedStatus: http.StatusOK,
+			expectedURLs:   []string{"http://localhost:8082", "http://localhost:8081"},
+		},
+		{
+			name:           "invalid weight",
+			method:         http.MethodPut,
+			target:         "/nodes/weight?url=http://localhost:8082",
+			body:           `{"weight": 0}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedURLs:   []string{"http://localhost:8081", "http://localhost:8082"},
+		},
+		{
+			name:           "drain unknown node",
+			method:         http.MethodPut,
+			target:         "/nodes/drain?url=http://localhost:8083",
+			body:           `{"draining": true}`,
+			expectedStatus: http.StatusNotFound,
+			expectedURLs:   []string{"http://localhost:8081", "http://localhost:8082"},
+		},
+		{
+			name:           "method not allowed",
+			method:         http.MethodGet,
+			target:         "/nodes/drain?url=http://localhost:8081",
+			expectedStatus: http.StatusMethodNotAllowed,
+			expectedURLs:   []string{"http://localhost:8081", "http://localhost:8082"},
+		},
+		{
+			name:           "unknown endpoint",
+			method:         http.MethodGet,
+			target:         "/unknown",
+			expectedStatus: http.StatusNotFound,
+			expectedURLs:   []string{"http://localhost:8081", "http://localhost:8082"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			lb := newAdminTestLB(t)
+			handler := NewAdminServer(lb, 9000).Handler
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body)))
+			g.Expect(w.Code).To(gomega.Equal(tc.expectedStatus))
+			g.Expect(w.Header().Get("Content-Type")).To(gomega.Equal("application/json"))
+
+			w = httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/nodes", nil))
+
+			var statuses []NodeStatus
+			g.Expect(json.NewDecoder(w.Body).Decode(&statuses)).To(gomega.Succeed())
+
+			urls := []string{}
+			for _, status := range statuses {
+				urls = append(urls, status.URL)
+			}
+			g.Expect(urls).To(gomega.Equal(tc.expectedURLs))
+		})
+	}
+}
+
+func TestAdminHandlerDrain(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	lb := newAdminTestLB(t)
+	handler := NewAdminServer(lb, 9000).Handler
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/nodes/drain?url=http://localhost:8081", strings.NewReader(`{"draining": true}`)))
+	g.Expect(w.Code).To(gomega.Equal(http.StatusOK))
+
+	var status NodeStatus
+	g.Expect(json.NewDecoder(w.Body).Decode(&status)).To(gomega.Succeed())
+	g.Expect(status.Draining).To(gomega.BeTrue())
+	g.Expect(status.CircuitState).To(gomega.Equal("closed"))
+
+	// the drained node is not selected anymore
+	node := lb.Node("http://localhost:8081")
+	g.Expect(node.Available()).To(gomega.BeFalse())
+	for i := 0; i < 3; i++ {
+		selected, err := lb.getNextHealthyNode(httptest.NewRequest(http.MethodGet, "/", nil))
+		g.Expect(err).To(gomega.BeNil())
+		g.Expect(selected.URL.String()).To(gomega.Equal("http://localhost:8082"))
+	}
+}
+
+func TestRouterAdminServer(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	rt, err := NewRouter(context.Background(), newRouterTestConfig(
+		map[string][]string{"shop": {"http://localhost:8081"}, "api": {"http://localhost:8082", "http://localhost:8083"}},
+		nil,
+		"shop",
+	))
+	g.Expect(err).To(gomega.BeNil())
+	defer rt.Close()
+
+	handler := NewRouterAdminServer(rt, 9000).Handler
+
+	testCases := []struct {
+		target         string
+		expectedStatus int
+		expectedURLs   []string
+	}{
+		{target: "/pools/shop/nodes", expectedStatus: http.StatusOK, expectedURLs: []string{"http://localhost:8081"}},
+		{target: "/pools/api/nodes", expectedStatus: http.StatusOK, expectedURLs: []string{"http://localhost:8082", "http://localhost:8083"}},
+		{target: "/pools/blog/nodes", expectedStatus: http.StatusNotFound},
+		{target: "/nodes", expectedStatus: http.StatusNotFound},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.target, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.target, nil))
+			g.Expect(w.Code).To(gomega.Equal(tc.expectedStatus))
+			if tc.expectedStatus != http.StatusOK {
+				return
+			}
+
+			var statuses []NodeStatus
+			g.Expect(json.NewDecoder(w.Body).Decode(&statuses)).To(gomega.Succeed())
+
+			urls := []string{}
+			for _, status := range statuses {
+				urls = append(urls, status.URL)
+			}
+			g.Expect(urls).To(gomega.Equal(tc.expectedURLs))
+		})
+	}
+
+	// nodes are managed per pool
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/pools/api/nodes?url=http://localhost:8083", nil))
+	g.Expect(w.Code).To(gomega.Equal(http.StatusOK))
+	g.Expect(nodeURLs(rt.Pool("api").nodes())).To(gomega.Equal([]string{"http://localhost:8082"}))
+	g.Expect(nodeURLs(rt.Pool("shop").nodes())).To(gomega.Equal([]string{"http://localhost:8081"}))
+}
+
+func TestAdminServerListensOnLoopback(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	g.Expect(NewAdminServer(newAdminTestLB(t), 9000).Addr).To(gomega.Equal("127.0.0.1:9000"))
+
+	rt, err := NewRouter(context.Background(), newRouterTestConfig(map[string][]string{"shop": {"http://localhost:8081"}}, nil, "shop"))
+	g.Expect(err).To(gomega.BeNil())
+	defer rt.Close()
+	g.Expect(NewRouterAdminServer(rt, 9000).Addr).To(gomega.Equal("127.0.0.1:9000"))
+}
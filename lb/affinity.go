@@ -0,0 +1,473 @@
+package lb
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultCookieName is the name of the session cookie when none is configured.
+const defaultCookieName = "session"
+
+// AffinityConfig configures the session affinity of a pool.
+// The session cookie holds an opaque ID of the node derived from its URL and signed with an
+// HMAC of Keys, so it neither reveals the address of the node nor can be forged by the
+// client. The first key signs the new cookies and every key is accepted when verifying them
+// and matching their node ID, so a new key can be
+// rolled out by prepending it and the old one removed once the cookies signed with it expired.
+// Without keys, a random key is generated on startup: sessions are then lost on restart and
+// not shared between instances of the load balancer.
+// A session expires when it wasn't used for IdleTTL or was created more than AbsoluteTTL ago,
+// the client then being pinned to a newly selected node. Zero TTLs never expire.
+//
+// Instead of a cookie, Mode can pin clients by their IP address or by the value of Header,
+// keeping the node of each client in memory. The IP address is taken from X-Forwarded-For
+// when the request comes from one of TrustedProxies, given as IP addresses or CIDR ranges.
+// In these modes, IdleTTL defaults to 30 minutes, and the table keeps at most MaxEntries
+// clients (100000 by default), evicting the least recently used ones. With the "none" mode,
+// clients aren't pinned at all and every request is balanced by the strategy.
+//
+// When the node of a session is down, the session fails over to the node picked by
+// rendezvous hashing of its ID, so the sessions of a failed node move together and land on
+// the same nodes every time. With Failback, sessions go back to their node once it recovers,
+// otherwise they stay on the node they failed over to.
+type AffinityConfig struct {
+	Mode           string       `json:"mode,omitempty"`
+	Keys           []string     `json:"keys,omitempty"`
+	Cookie         CookieConfig `json:"cookie,omitempty"`
+	Header         string       `json:"header,omitempty"`
+	TrustedProxies []string     `json:"trusted_proxies,omitempty"`
+	MaxEntries     int          `json:"max_entries,omitempty"`
+	IdleTTL        Duration     `json:"idle_ttl,omitempty"`
+	AbsoluteTTL    Duration     `json:"absolute_ttl,omitempty"`
+	Failback       bool         `json:"failback,omitempty"`
+}
+
+// CookieConfig configures the name and attributes of the session cookie.
+// The name defaults to "session" and the path to "/". SameSite is either "lax", "strict"
+// or "none", which requires Secure, and is left unset by default. Without MaxAge the cookie lasts until the
+// browser is closed.
+type CookieConfig struct {
+	Name     string   `json:"name,omitempty"`
+	Path     string   `json:"path,omitempty"`
+	Domain   string   `json:"domain,omitempty"`
+	MaxAge   Duration `json:"max_age,omitempty"`
+	HTTPOnly bool     `json:"http_only,omitempty"`
+	Secure   bool     `json:"secure,omitempty"`
+	SameSite string   `json:"same_site,omitempty"`
+}
+
+// validate checks the configuration and fills in the default values.
+func (cfg *AffinityConfig) validate() error {
+	for _, key := range cfg.Keys {
+		if key == "" {
+			return errors.New("affinity keys can't be empty")
+		}
+	}
+
+	if cfg.IdleTTL < 0 || cfg.AbsoluteTTL < 0 || cfg.Cookie.MaxAge < 0 {
+		return errors.New("affinity durations can't be negative")
+	}
+
+	if cfg.MaxEntries < 0 {
+		return errors.New("affinity max entries can't be negative")
+	}
+
+	sameSite, err := parseSameSite(cfg.Cookie.SameSite)
+	if err != nil {
+		return err
+	}
+
+	// browsers reject SameSite=None cookies that aren't secure
+	if sameSite == http.SameSiteNoneMode && !cfg.Cookie.Secure {
+		return errors.New("affinity cookie with same site 'none' must be secure")
+	}
+
+	if _, err := parseTrustedProxies(cfg.TrustedProxies); err != nil {
+		return err
+	}
+
+	switch cfg.Mode {
+	case "":
+		cfg.Mode = AffinityCookie
+	case AffinityCookie, AffinityIP, AffinityNone:
+	case AffinityHeader:
+		if cfg.Header == "" {
+			return errors.New("affinity header is required in header mode")
+		}
+	default:
+		return fmt.Errorf("invalid affinity mode '%s'", cfg.Mode)
+	}
+
+	if cfg.Mode == AffinityIP || cfg.Mode == AffinityHeader {
+		if cfg.IdleTTL == 0 {
+			cfg.IdleTTL = Duration(defaultAffinityTableIdleTTL)
+		}
+		if cfg.MaxEntries == 0 {
+			cfg.MaxEntries = defaultAffinityTableMaxEntries
+		}
+	}
+
+	if cfg.Cookie.Name == "" {
+		cfg.Cookie.Name = defaultCookieName
+	}
+
+	if cfg.Cookie.Path == "" {
+		cfg.Cookie.Path = "/"
+	}
+
+	return nil
+}
+
+// parseSameSite returns the SameSite attribute matching its configuration.
+func parseSameSite(sameSite string) (http.SameSite, error) {
+	switch strings.ToLower(sameSite) {
+	case "":
+		return http.SameSiteDefaultMode, nil
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	}
+	return 0, fmt.Errorf("invalid same site '%s'", sameSite)
+}
+
+// newCookie returns the session cookie holding value.
+func (cfg *CookieConfig) newCookie(value string) *http.Cookie {
+	sameSite, _ := parseSameSite(cfg.SameSite)
+
+	return &http.Cookie{
+		Name:     cfg.Name,
+		Value:    value,
+		Path:     cfg.Path,
+		Domain:   cfg.Domain,
+		MaxAge:   int(time.Duration(cfg.MaxAge) / time.Second),
+		HttpOnly: cfg.HTTPOnly,
+		Secure:   cfg.Secure,
+		SameSite: sameSite,
+	}
+}
+
+// session is the content of a session cookie: the ID of the session, the node the client is
+// pinned to, when the session was created and when it was last used.
+type session struct {
+	id      string
+	nodeID  string
+	created time.Time
+	seen    time.Time
+}
+
+// encode returns the session as a cookie value, before signing.
+func (s session) encode() string {
+	return fmt.Sprintf("%s.%s.%d.%d", s.id, s.nodeID, s.created.Unix(), s.seen.Unix())
+}
+
+// decodeSession decodes the session encoded in a cookie value.
+func decodeSession(value string) (session, bool) {
+	parts := strings.Split(value, ".")
+	if len(parts) != 4 {
+		return session{}, false
+	}
+
+	created, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return session{}, false
+	}
+
+	seen, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil {
+		return session{}, false
+	}
+
+	return session{id: parts[0], nodeID: parts[1], created: time.Unix(created, 0), seen: time.Unix(seen, 0)}, true
+}
+
+// expired reports whether the session is expired at now.
+func (cfg *AffinityConfig) expired(s session, now time.Time) bool {
+	if cfg.IdleTTL > 0 && now.Sub(s.seen) > time.Duration(cfg.IdleTTL) {
+		return true
+	}
+	return cfg.AbsoluteTTL > 0 && now.Sub(s.created) > time.Duration(cfg.AbsoluteTTL)
+}
+
+// cookieSigner signs and verifies the values of the session cookies.
+type cookieSigner struct {
+	keys [][]byte
+}
+
+// newCookieSigner creates a signer signing with the first key and verifying with all of them.
+// A random key is used when none is given.
+func newCookieSigner(keys []string) (*cookieSigner, error) {
+	s := &cookieSigner{}
+	for _, key := range keys {
+		s.keys = append(s.keys, []byte(key))
+	}
+
+	if len(s.keys) == 0 {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		s.keys = append(s.keys, key)
+	}
+
+	return s, nil
+}
+
+// sign returns the value followed by its signature.
+func (s *cookieSigner) sign(value string) string {
+	return value + "." + base64.RawURLEncoding.EncodeToString(s.mac(s.keys[0], value))
+}
+
+// verify returns the value of a signed value, and false if its signature doesn't match any key.
+func (s *cookieSigner) verify(signed string) (string, bool) {
+	i := strings.LastIndexByte(signed, '.')
+	if i < 0 {
+		return "", false
+	}
+
+	value := signed[:i]
+	signature, err := base64.RawURLEncoding.DecodeString(signed[i+1:])
+	if err != nil {
+		return "", false
+	}
+
+	for _, key := range s.keys {
+		if hmac.Equal(signature, s.mac(key, value)) {
+			return value, true
+		}
+	}
+
+	return "", false
+}
+
+// nodeID returns the opaque ID of the node at u in the session cookies, an HMAC of its URL
+// with the signing key, so it's the same for every instance of the load balancer sharing
+// the keys and the URL can't be guessed from it.
+func (s *cookieSigner) nodeID(u *url.URL) string {
+	return s.keyedNodeID(s.keys[0], u)
+}
+
+// nodeIDs returns the IDs of the node at u made with every key, the one of the signing key
+// first, so that the sessions created before a new key was rolled out keep their node.
+func (s *cookieSigner) nodeIDs(u *url.URL) []string {
+	ids := make([]string, 0, len(s.keys))
+	for _, key := range s.keys {
+		ids = append(ids, s.keyedNodeID(key, u))
+	}
+
+	return ids
+}
+
+func (s *cookieSigner) keyedNodeID(key []byte, u *url.URL) string {
+	return hex.EncodeToString(s.mac(key, "node:"+u.String())[:8])
+}
+
+func (s *cookieSigner) mac(key []byte, value string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(value))
+	return h.Sum(nil)
+}
+
+// setupAffinity validates the affinity settings and creates the signer of the session cookies.
+func (lb *LB) setupAffinity() error {
+	cfg := AffinityConfig{}
+	if lb.affinity != nil {
+		if err := lb.affinity.validate(); err != nil {
+			return err
+		}
+		cfg = *lb.affinity
+	}
+
+	lb.table = nil
+	if lb.affinity != nil && (lb.affinity.Mode == AffinityIP || lb.affinity.Mode == AffinityHeader) {
+		table, err := newAffinityTable(lb.affinity)
+		if err != nil {
+			return err
+		}
+		lb.table = table
+	}
+
+	signer, err := newCookieSigner(cfg.Keys)
+	if err != nil {
+		return err
+	}
+
+	lb.mux.Lock()
+	lb.signer = signer
+	lb.nodeIDs = nil
+	lb.mux.Unlock()
+
+	return nil
+}
+
+// cookieSigner returns the signer of the session cookies, creating one with a random key
+// if the load balancer wasn't set up.
+func (lb *LB) cookieSigner() *cookieSigner {
+	lb.mux.RLock()
+	signer := lb.signer
+	lb.mux.RUnlock()
+	if signer != nil {
+		return signer
+	}
+
+	lb.mux.Lock()
+	defer lb.mux.Unlock()
+
+	return lb.cookieSignerLocked()
+}
+
+// cookieSignerLocked is cookieSigner for callers holding the lock.
+func (lb *LB) cookieSignerLocked() *cookieSigner {
+	if lb.signer == nil {
+		lb.signer, _ = newCookieSigner(nil)
+	}
+	return lb.signer
+}
+
+// nodeByID returns the node whose ID in the session cookies is id, made with any of the
+// keys, or nil if there is none.
+func (lb *LB) nodeByID(id string) *Node {
+	lb.mux.RLock()
+	index := lb.nodeIDs
+	lb.mux.RUnlock()
+
+	if index == nil {
+		lb.mux.Lock()
+		if lb.nodeIDs == nil {
+			lb.indexNodeIDsLocked()
+		}
+		index = lb.nodeIDs
+		lb.mux.Unlock()
+	}
+
+	return index[id]
+}
+
+// indexNodeIDsLocked indexes the nodes by their IDs in the session cookies. The index is
+// replaced rather than modified, so lookups never see it change.
+// The lock must be held.
+func (lb *LB) indexNodeIDsLocked() {
+	signer := lb.cookieSignerLocked()
+
+	index := make(map[string]*Node, len(lb.Nodes)*len(signer.keys))
+	for _, n := range lb.Nodes {
+		ids := n.sessionIDs()
+		if ids == nil {
+			ids = signer.nodeIDs(n.URL)
+		}
+
+		for _, id := range ids {
+			index[id] = n
+		}
+	}
+
+	lb.nodeIDs = index
+}
+
+// affinityConfig returns the affinity settings of the load balancer.
+func (lb *LB) affinityConfig() *AffinityConfig {
+	if lb.affinity != nil {
+		return lb.affinity
+	}
+	return &AffinityConfig{Mode: AffinityCookie, Cookie: CookieConfig{Name: defaultCookieName, Path: "/"}}
+}
+
+// readSession returns the valid, unexpired session held by the cookie value.
+func (lb *LB) readSession(value string, now time.Time) (session, bool) {
+	payload, ok := lb.cookieSigner().verify(value)
+	if !ok {
+		return session{}, false
+	}
+
+	s, ok := decodeSession(payload)
+	if !ok || lb.affinityConfig().expired(s, now) {
+		return session{}, false
+	}
+
+	return s, true
+}
+
+// writeSession sets the session cookie holding s in the HTTP response writer w.
+func (lb *LB) writeSession(w http.ResponseWriter, s session) {
+	cfg := lb.affinityConfig()
+	http.SetCookie(w, cfg.Cookie.newCookie(lb.cookieSigner().sign(s.encode())))
+}
+
+// selectServerByTable selects the node the client is pinned to in the affinity table, and
+// pins it to the next healthy node when it isn't pinned yet. When its node can't serve it,
+// the client fails over like a session whose ID is the key.
+// Requests without key, such as the ones missing the affinity header, are not pinned.
+func (lb *LB) selectServerByTable(r *http.Request) (*Node, error) {
+	key := lb.table.key(r)
+	if key == "" {
+		return lb.getNextHealthyNode(r)
+	}
+
+	now := time.Now()
+	if u, ok := lb.table.lookup(key, now); ok {
+		pinned := lb.Node(u)
+		if pinned != nil && lb.acceptsSession(pinned) {
+			return pinned, nil
+		}
+
+		node, err := lb.failoverNode(key)
+		if err != nil {
+			return nil, err
+		}
+
+		if pinned == nil || !lb.affinityConfig().Failback {
+			lb.table.pin(key, node.URL.String(), now)
+		}
+
+		return node, nil
+	}
+
+	node, err := lb.getNextHealthyNode(r)
+	if err != nil {
+		return nil, err
+	}
+
+	lb.table.pin(key, node.URL.String(), now)
+
+	return node, nil
+}
+
+// repin pins the client of the request to another node, after its request was retried on it.
+func (lb *LB) repin(w http.ResponseWriter, r *http.Request, node *Node) {
+	if lb.affinityConfig().Mode == AffinityNone {
+		return
+	}
+
+	if lb.table != nil {
+		if key := lb.table.key(r); key != "" {
+			lb.table.pin(key, node.URL.String(), time.Now())
+		}
+		return
+	}
+
+	// the session keeps its ID
+	w.Header().Del("Set-Cookie")
+	now := time.Now()
+	if cookie, err := r.Cookie(lb.affinityConfig().Cookie.Name); err == nil {
+		if s, ok := lb.readSession(cookie.Value, now); ok {
+			s.nodeID = lb.cookieSigner().nodeID(node.URL)
+			s.seen = now
+			lb.writeSession(w, s)
+			return
+		}
+	}
+
+	lb.setCookie(w, node)
+}
@@ -0,0 +1,449 @@
+package lb
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bsm/gomega"
+)
+
+// sessionValue returns the value of a session cookie pinning a client to the node.
+func sessionValue(signer *cookieSigner, node *Node) string {
+	now := time.Now()
+	return signer.sign(session{id: newSessionID(), nodeID: signer.nodeID(node.URL), created: now, seen: now}.encode())
+}
+
+func TestNodeID(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	n1, _ := newNode(ServerConfig{URL: "http://10.0.3.7:8081"})
+	n2, _ := newNode(ServerConfig{URL: "http://10.0.3.7:8082"})
+	nodes := []*Node{n1, n2}
+
+	oldSigner, _ := newCookieSigner([]string{"old"})
+	rotatedSigner, _ := newCookieSigner([]string{"new", "old"})
+	newSigner, _ := newCookieSigner([]string{"new"})
+
+	g.Expect(oldSigner.nodeID(n1.URL)).To(gomega.Equal(oldSigner.nodeID(n1.URL)))
+	g.Expect(oldSigner.nodeID(n1.URL)).NotTo(gomega.Equal(oldSigner.nodeID(n2.URL)))
+	g.Expect(oldSigner.nodeID(n1.URL)).NotTo(gomega.ContainSubstring("10.0.3.7"))
+
+	// the ID depends on the key, so it can't be computed from the URL alone
+	g.Expect(newSigner.nodeID(n1.URL)).NotTo(gomega.Equal(oldSigner.nodeID(n1.URL)))
+	g.Expect(rotatedSigner.nodeID(n1.URL)).To(gomega.Equal(newSigner.nodeID(n1.URL)))
+
+	// IDs made with any of the keys are accepted during a rotation
+	g.Expect(rotatedSigner.nodeIDs(n2.URL)).To(gomega.Equal([]string{newSigner.nodeID(n2.URL), oldSigner.nodeID(n2.URL)}))
+
+	lb := &LB{Nodes: nodes, affinity: &AffinityConfig{Keys: []string{"new", "old"}}}
+	g.Expect(lb.setupNodes()).To(gomega.BeNil())
+	g.Expect(lb.nodeByID(oldSigner.nodeID(n2.URL))).To(gomega.Equal(n2))
+	g.Expect(lb.nodeByID(newSigner.nodeID(n2.URL))).To(gomega.Equal(n2))
+
+	lb = &LB{Nodes: nodes, affinity: &AffinityConfig{Keys: []string{"new"}}}
+	g.Expect(lb.setupNodes()).To(gomega.BeNil())
+	g.Expect(lb.nodeByID(oldSigner.nodeID(n2.URL))).To(gomega.BeNil())
+
+	// the index follows the nodes added and removed
+	n3, err := lb.AddNode(ServerConfig{URL: "http://localhost:8083"})
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(lb.nodeByID(newSigner.nodeID(n3.URL))).To(gomega.Equal(n3))
+
+	_, err = lb.RemoveNode(n1.URL.String())
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(lb.nodeByID(newSigner.nodeID(n1.URL))).To(gomega.BeNil())
+}
+
+func TestCookieSigner(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	oldSigner, err := newCookieSigner([]string{"old"})
+	g.Expect(err).To(gomega.BeNil())
+	rotatedSigner, err := newCookieSigner([]string{"new", "old"})
+	g.Expect(err).To(gomega.BeNil())
+	newSigner, err := newCookieSigner([]string{"new"})
+	g.Expect(err).To(gomega.BeNil())
+
+	signed := oldSigner.sign("c59e7cca4819bb19")
+	g.Expect(signed).To(gomega.HavePrefix("c59e7cca4819bb19."))
+
+	testCases := []struct {
+		name          string
+		signer        *cookieSigner
+		value         string
+		expectedValue string
+		expectedOK    bool
+	}{
+		{
+			name:          "same key",
+			signer:        oldSigner,
+			value:         signed,
+			expectedValue: "c59e7cca4819bb19",
+			expectedOK:    true,
+		},
+		{
+			name:          "old key still verified during rotation",
+			signer:        rotatedSigner,
+			value:         signed,
+			expectedValue: "c59e7cca4819bb19",
+			expectedOK:    true,
+		},
+		{
+			name:   "old key removed",
+			signer: newSigner,
+			value:  signed,
+		},
+		{
+			name:   "tampered value",
+			signer: oldSigner,
+			value:  strings.Replace(signed, "c59e", "d59e", 1),
+		},
+		{
+			name:   "no signature",
+			signer: oldSigner,
+			value:  "http://10.0.3.7:8081",
+		},
+		{
+			name:   "invalid signature",
+			signer: oldSigner,
+			value:  "c59e7cca4819bb19.!!",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			value, ok := tc.signer.verify(tc.value)
+
+			g.Expect(ok).To(gomega.Equal(tc.expectedOK))
+			g.Expect(value).To(gomega.Equal(tc.expectedValue))
+		})
+	}
+
+	// the first key signs
+	_, ok := newSigner.verify(rotatedSigner.sign("c59e7cca4819bb19"))
+	g.Expect(ok).To(gomega.BeTrue())
+
+	// without keys a random one is used
+	randomSigner, err := newCookieSigner(nil)
+	g.Expect(err).To(gomega.BeNil())
+	otherRandomSigner, err := newCookieSigner(nil)
+	g.Expect(err).To(gomega.BeNil())
+	_, ok = randomSigner.verify(randomSigner.sign("id"))
+	g.Expect(ok).To(gomega.BeTrue())
+	_, ok = otherRandomSigner.verify(randomSigner.sign("id"))
+	g.Expect(ok).To(gomega.BeFalse())
+}
+
+func TestAffinityConfigValidate(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	testCases := []struct {
+		name        string
+		cfg         AffinityConfig
+		expectedCfg AffinityConfig
+		expectedErr bool
+	}{
+		{
+			name:        "defaults",
+			cfg:         AffinityConfig{},
+			expectedCfg: AffinityConfig{Mode: "cookie", Cookie: CookieConfig{Name: "session", Path: "/"}},
+		},
+		{
+			name: "custom",
+			cfg: AffinityConfig{
+				Keys:        []string{"new", "old"},
+				Cookie:      CookieConfig{Name: "lb", Path: "/app", SameSite: "Lax"},
+				IdleTTL:     Duration(time.Minute),
+				AbsoluteTTL: Duration(time.Hour),
+			},
+			expectedCfg: AffinityConfig{
+				Mode:        "cookie",
+				Keys:        []string{"new", "old"},
+				Cookie:      CookieConfig{Name: "lb", Path: "/app", SameSite: "Lax"},
+				IdleTTL:     Duration(time.Minute),
+				AbsoluteTTL: Duration(time.Hour),
+			},
+		},
+		{
+			name: "ip mode",
+			cfg:  AffinityConfig{Mode: "ip", TrustedProxies: []string{"10.0.0.0/8", "192.168.1.1"}},
+			expectedCfg: AffinityConfig{
+				Mode:           "ip",
+				Cookie:         CookieConfig{Name: "session", Path: "/"},
+				TrustedProxies: []string{"10.0.0.0/8", "192.168.1.1"},
+				IdleTTL:        Duration(30 * time.Minute),
+				MaxEntries:     100000,
+			},
+		},
+		{
+			name: "header mode",
+			cfg:  AffinityConfig{Mode: "header", Header: "X-Tenant-ID", IdleTTL: Duration(time.Minute), MaxEntries: 1000},
+			expectedCfg: AffinityConfig{
+				Mode:       "header",
+				Cookie:     CookieConfig{Name: "session", Path: "/"},
+				Header:     "X-Tenant-ID",
+				IdleTTL:    Duration(time.Minute),
+				MaxEntries: 1000,
+			},
+		},
+		{
+			name: "none mode",
+			cfg:  AffinityConfig{Mode: "none"},
+			expectedCfg: AffinityConfig{
+				Mode:   "none",
+				Cookie: CookieConfig{Name: "session", Path: "/"},
+			},
+		},
+		{
+			name:        "invalid mode",
+			cfg:         AffinityConfig{Mode: "random"},
+			expectedErr: true,
+		},
+		{
+			name:        "header mode without header",
+			cfg:         AffinityConfig{Mode: "header"},
+			expectedErr: true,
+		},
+		{
+			name:        "negative max entries",
+			cfg:         AffinityConfig{Mode: "ip", MaxEntries: -1},
+			expectedErr: true,
+		},
+		{
+			name:        "invalid trusted proxy",
+			cfg:         AffinityConfig{Mode: "ip", TrustedProxies: []string{"10.0.0.0/33"}},
+			expectedErr: true,
+		},
+		{
+			name:        "empty key",
+			cfg:         AffinityConfig{Keys: []string{"new", ""}},
+			expectedErr: true,
+		},
+		{
+			name:        "negative ttl",
+			cfg:         AffinityConfig{IdleTTL: Duration(-time.Minute)},
+			expectedErr: true,
+		},
+		{
+			name:        "invalid same site",
+			cfg:         AffinityConfig{Cookie: CookieConfig{SameSite: "sometimes"}},
+			expectedErr: true,
+		},
+		{
+			name:        "same site none without secure",
+			cfg:         AffinityConfig{Cookie: CookieConfig{SameSite: "None"}},
+			expectedErr: true,
+		},
+		{
+			name: "same site none with secure",
+			cfg:  AffinityConfig{Cookie: CookieConfig{SameSite: "none", Secure: true}},
+			expectedCfg: AffinityConfig{
+				Mode:   "cookie",
+				Cookie: CookieConfig{Name: "session", Path: "/", SameSite: "none", Secure: true},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := tc.cfg
+			err := cfg.validate()
+
+			if tc.expectedErr {
+				g.Expect(err).NotTo(gomega.BeNil())
+			} else {
+				g.Expect(err).To(gomega.BeNil())
+				g.Expect(cfg).To(gomega.Equal(tc.expectedCfg))
+			}
+		})
+	}
+}
+
+func TestCookieConfigNewCookie(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	cfg := CookieConfig{
+		Name:     "lb",
+		Path:     "/app",
+		Domain:   "example.com",
+		MaxAge:   Duration(time.Hour),
+		HTTPOnly: true,
+		Secure:   true,
+		SameSite: "strict",
+	}
+
+	g.Expect(cfg.newCookie("value")).To(gomega.Equal(&http.Cookie{
+		Name:     "lb",
+		Value:    "value",
+		Path:     "/app",
+		Domain:   "example.com",
+		MaxAge:   3600,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	}))
+}
+
+func TestSessionEncode(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	s := session{id: "5f1e2d3c4b5a6978", nodeID: "c59e7cca4819bb19", created: time.Unix(1700000000, 0), seen: time.Unix(1700000060, 0)}
+
+	decoded, ok := decodeSession(s.encode())
+	g.Expect(ok).To(gomega.BeTrue())
+	g.Expect(decoded).To(gomega.Equal(s))
+
+	for _, value := range []string{"", "c59e7cca4819bb19", "c59e7cca4819bb19.1.1", "s.c59e7cca4819bb19.x.1", "s.c59e7cca4819bb19.1.x", "s.a.1.1.1"} {
+		_, ok := decodeSession(value)
+		g.Expect(ok).To(gomega.BeFalse())
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	now := time.Now()
+
+	testCases := []struct {
+		name     string
+		cfg      AffinityConfig
+		session  session
+		expected bool
+	}{
+		{
+			name:    "no ttl",
+			cfg:     AffinityConfig{},
+			session: session{created: now.Add(-24 * time.Hour), seen: now.Add(-24 * time.Hour)},
+		},
+		{
+			name:    "used recently",
+			cfg:     AffinityConfig{IdleTTL: Duration(time.Minute), AbsoluteTTL: Duration(time.Hour)},
+			session: session{created: now.Add(-30 * time.Minute), seen: now.Add(-30 * time.Second)},
+		},
+		{
+			name:     "idle",
+			cfg:      AffinityConfig{IdleTTL: Duration(time.Minute), AbsoluteTTL: Duration(time.Hour)},
+			session:  session{created: now.Add(-30 * time.Minute), seen: now.Add(-2 * time.Minute)},
+			expected: true,
+		},
+		{
+			name:     "too old",
+			cfg:      AffinityConfig{IdleTTL: Duration(time.Minute), AbsoluteTTL: Duration(time.Hour)},
+			session:  session{created: now.Add(-2 * time.Hour), seen: now.Add(-30 * time.Second)},
+			expected: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			g.Expect(tc.cfg.expired(tc.session, now)).To(gomega.Equal(tc.expected))
+		})
+	}
+}
+
+func TestSelectServerBySessionCookie(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	lb, err := newServerNodes(serverConfigs([]string{"http://localhost:8081", "http://localhost:8082"}))
+	g.Expect(err).To(gomega.BeNil())
+	WithStrategy(firstNodeStrategy{})(lb)
+	WithAffinity(AffinityConfig{
+		Keys:        []string{"secret"},
+		Cookie:      CookieConfig{Name: "lb", HTTPOnly: true},
+		IdleTTL:     Duration(time.Minute),
+		AbsoluteTTL: Duration(time.Hour),
+	})(lb)
+	g.Expect(lb.setupNodes()).To(gomega.BeNil())
+
+	pinned := lb.Nodes[1]
+	now := time.Now()
+
+	testCases := []struct {
+		name          string
+		cookie        *http.Cookie
+		expectedNode  *Node
+		expectedFresh bool
+	}{
+		{
+			name:          "valid session is kept alive",
+			cookie:        &http.Cookie{Name: "lb", Value: lb.cookieSigner().sign(session{nodeID: lb.cookieSigner().nodeID(pinned.URL), created: now.Add(-10 * time.Minute), seen: now.Add(-30 * time.Second)}.encode())},
+			expectedNode:  pinned,
+			expectedFresh: false,
+		},
+		{
+			name:          "idle session starts a new one",
+			cookie:        &http.Cookie{Name: "lb", Value: lb.cookieSigner().sign(session{nodeID: lb.cookieSigner().nodeID(pinned.URL), created: now.Add(-10 * time.Minute), seen: now.Add(-2 * time.Minute)}.encode())},
+			expectedNode:  lb.Nodes[0],
+			expectedFresh: true,
+		},
+		{
+			name:          "old session starts a new one",
+			cookie:        &http.Cookie{Name: "lb", Value: lb.cookieSigner().sign(session{nodeID: lb.cookieSigner().nodeID(pinned.URL), created: now.Add(-2 * time.Hour), seen: now}.encode())},
+			expectedNode:  lb.Nodes[0],
+			expectedFresh: true,
+		},
+		{
+			name:          "cookie with another name is ignored",
+			cookie:        &http.Cookie{Name: "session", Value: sessionValue(lb.cookieSigner(), pinned)},
+			expectedNode:  lb.Nodes[0],
+			expectedFresh: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.AddCookie(tc.cookie)
+			w := httptest.NewRecorder()
+
+			node, err := lb.selectServer(w, r)
+			g.Expect(err).To(gomega.BeNil())
+			g.Expect(node).To(gomega.BeIdenticalTo(tc.expectedNode))
+
+			// the cookie is set again with its attributes, either refreshed or for a new session
+			cookies := w.Result().Cookies()
+			g.Expect(cookies).To(gomega.HaveLen(1))
+			g.Expect(cookies[0].Name).To(gomega.Equal("lb"))
+			g.Expect(cookies[0].HttpOnly).To(gomega.BeTrue())
+
+			s, ok := lb.readSession(cookies[0].Value, time.Now())
+			g.Expect(ok).To(gomega.BeTrue())
+			g.Expect(s.nodeID).To(gomega.Equal(lb.cookieSigner().nodeID(tc.expectedNode.URL)))
+			g.Expect(time.Since(s.seen)).To(gomega.BeNumerically("<", 2*time.Second))
+			g.Expect(time.Since(s.created) < 2*time.Second).To(gomega.Equal(tc.expectedFresh))
+		})
+	}
+}
+
+func TestSelectServerWithoutAffinity(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	lb, err := newServerNodes(serverConfigs([]string{"http://localhost:8081", "http://localhost:8082", "http://localhost:8083"}))
+	g.Expect(err).To(gomega.BeNil())
+	WithStrategy(NewConsistentHash(HashByPath(), 0))(lb)
+	WithAffinity(AffinityConfig{Mode: AffinityNone})(lb)
+	g.Expect(lb.setupNodes()).To(gomega.BeNil())
+
+	// the strategy decides every request, session cookies being neither read nor set
+	cookie := &http.Cookie{Name: "session", Value: sessionValue(lb.cookieSigner(), lb.Nodes[0])}
+	selected := map[*Node]bool{}
+	for i := 0; i < 20; i++ {
+		r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/items/%d", i), nil)
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+
+		node, err := lb.selectServer(w, r)
+		g.Expect(err).To(gomega.BeNil())
+		g.Expect(w.Result().Cookies()).To(gomega.BeEmpty())
+
+		expected, err := lb.strategy.Select(lb.nodes(), r)
+		g.Expect(err).To(gomega.BeNil())
+		g.Expect(node).To(gomega.BeIdenticalTo(expected))
+		selected[node] = true
+	}
+	g.Expect(len(selected)).To(gomega.BeNumerically(">", 1))
+}
@@ -0,0 +1,211 @@
+package lb
+
+import (
+	"container/list"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Session affinity modes.
+const (
+	AffinityCookie = "cookie"
+	AffinityIP     = "ip"
+	AffinityHeader = "header"
+	AffinityNone   = "none"
+)
+
+// Default affinity table settings.
+const (
+	defaultAffinityTableIdleTTL    = 30 * time.Minute
+	defaultAffinityTableMaxEntries = 100000
+)
+
+// affinityEntry pins a client to a node in the affinity table.
+type affinityEntry struct {
+	key     string
+	nodeURL string
+	created time.Time
+	seen    time.Time
+}
+
+// affinityTable pins clients identified by a key of their requests, such as their IP address
+// or a header, to a node. Entries expire like the sessions of the session cookies, and the
+// least recently used entry is evicted when the table holds more than MaxEntries entries.
+type affinityTable struct {
+	cfg       *AffinityConfig
+	key       HashKeyFunc
+	mux       sync.Mutex
+	entries   map[string]*list.Element
+	recent    *list.List
+	lastSweep time.Time
+}
+
+// newAffinityTable creates the affinity table of a validated configuration in IP or header mode.
+func newAffinityTable(cfg *AffinityConfig) (*affinityTable, error) {
+	t := &affinityTable{
+		cfg:     cfg,
+		entries: map[string]*list.Element{},
+		recent:  list.New(),
+	}
+
+	switch cfg.Mode {
+	case AffinityIP:
+		proxies, err := parseTrustedProxies(cfg.TrustedProxies)
+		if err != nil {
+			return nil, err
+		}
+		t.key = func(r *http.Request) string {
+			return forwardedClientIP(r, proxies)
+		}
+	case AffinityHeader:
+		t.key = HashByHeader(cfg.Header)
+	default:
+		return nil, fmt.Errorf("no affinity table in %s mode", cfg.Mode)
+	}
+
+	return t, nil
+}
+
+// lookup returns the URL of the node the key is pinned to at now, and marks the entry as used.
+func (t *affinityTable) lookup(key string, now time.Time) (string, bool) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	elem, ok := t.entries[key]
+	if !ok {
+		return "", false
+	}
+
+	entry := elem.Value.(*affinityEntry)
+	if t.cfg.expired(session{created: entry.created, seen: entry.seen}, now) {
+		t.remove(elem)
+		return "", false
+	}
+
+	entry.seen = now
+	t.recent.MoveToFront(elem)
+	return entry.nodeURL, true
+}
+
+// pin pins the key to the node at the given URL from now on. An existing entry keeps the
+// time it was created.
+func (t *affinityTable) pin(key, nodeURL string, now time.Time) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	if elem, ok := t.entries[key]; ok {
+		entry := elem.Value.(*affinityEntry)
+		entry.nodeURL = nodeURL
+		entry.seen = now
+		t.recent.MoveToFront(elem)
+	} else {
+		t.entries[key] = t.recent.PushFront(&affinityEntry{key: key, nodeURL: nodeURL, created: now, seen: now})
+	}
+
+	if t.cfg.MaxEntries > 0 && len(t.entries) > t.cfg.MaxEntries {
+		t.remove(t.recent.Back())
+	}
+
+	// drop the expired entries from time to time so the table doesn't grow forever
+	if now.Sub(t.lastSweep) < time.Duration(t.cfg.IdleTTL) {
+		return
+	}
+	t.lastSweep = now
+
+	for _, elem := range t.entries {
+		entry := elem.Value.(*affinityEntry)
+		if t.cfg.expired(session{created: entry.created, seen: entry.seen}, now) {
+			t.remove(elem)
+		}
+	}
+}
+
+// remove removes the entry of the list element from the table.
+func (t *affinityTable) remove(elem *list.Element) {
+	entry := t.recent.Remove(elem).(*affinityEntry)
+	delete(t.entries, entry.key)
+}
+
+// len returns the number of entries of the table.
+func (t *affinityTable) len() int {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	return len(t.entries)
+}
+
+// parseTrustedProxies parses a list of IP addresses and CIDR ranges.
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy '%s'", proxy)
+			}
+
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			proxy = fmt.Sprintf("%s/%d", proxy, bits)
+		}
+
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy '%s'", proxy)
+		}
+		nets = append(nets, ipNet)
+	}
+
+	return nets, nil
+}
+
+// isTrustedProxy reports whether the IP address belongs to one of the trusted proxies.
+func isTrustedProxy(ip string, proxies []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+
+	for _, proxy := range proxies {
+		if proxy.Contains(parsed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forwardedClientIP returns the IP address of the client that sent the request. When the
+// request comes from a trusted proxy, the X-Forwarded-For header is walked from the right
+// and the first address that isn't a trusted proxy is the client.
+func forwardedClientIP(r *http.Request, proxies []*net.IPNet) string {
+	ip := clientIP(r)
+	if !isTrustedProxy(ip, proxies) {
+		return ip
+	}
+
+	forwarded := []string{}
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(value, ",")...)
+	}
+
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+
+		ip = hop
+		if !isTrustedProxy(ip, proxies) {
+			break
+		}
+	}
+
+	return ip
+}
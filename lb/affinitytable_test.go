@@ -0,0 +1,172 @@
+package lb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bsm/gomega"
+)
+
+func TestForwardedClientIP(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"})
+	g.Expect(err).To(gomega.BeNil())
+
+	testCases := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		expectedIP string
+	}{
+		{
+			name:       "direct client",
+			remoteAddr: "203.0.113.7:51234",
+			expectedIP: "203.0.113.7",
+		},
+		{
+			name:       "untrusted proxy is the client",
+			remoteAddr: "203.0.113.7:51234",
+			forwarded:  []string{"198.51.100.1"},
+			expectedIP: "203.0.113.7",
+		},
+		{
+			name:       "trusted proxy",
+			remoteAddr: "10.0.0.2:51234",
+			forwarded:  []string{"198.51.100.1"},
+			expectedIP: "198.51.100.1",
+		},
+		{
+			name:       "chain of trusted proxies",
+			remoteAddr: "10.0.0.2:51234",
+			forwarded:  []string{"6.6.6.6, 198.51.100.1, 192.168.1.1", "10.1.2.3"},
+			expectedIP: "198.51.100.1",
+		},
+		{
+			name:       "ipv6 trusted proxy",
+			remoteAddr: "[fd00::1]:51234",
+			forwarded:  []string{"2001:db8::1"},
+			expectedIP: "2001:db8::1",
+		},
+		{
+			name:       "invalid hop",
+			remoteAddr: "10.0.0.2:51234",
+			forwarded:  []string{"198.51.100.1, unknown, 10.0.0.3"},
+			expectedIP: "10.0.0.3",
+		},
+		{
+			name:       "trusted proxy without header",
+			remoteAddr: "10.0.0.2:51234",
+			expectedIP: "10.0.0.2",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tc.remoteAddr
+			for _, forwarded := range tc.forwarded {
+				r.Header.Add("X-Forwarded-For", forwarded)
+			}
+
+			g.Expect(forwardedClientIP(r, proxies)).To(gomega.Equal(tc.expectedIP))
+		})
+	}
+}
+
+func TestAffinityTableExpiry(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	cfg := &AffinityConfig{Mode: AffinityHeader, Header: "X-Tenant-ID", IdleTTL: Duration(time.Minute), AbsoluteTTL: Duration(time.Hour)}
+	table, err := newAffinityTable(cfg)
+	g.Expect(err).To(gomega.BeNil())
+
+	now := time.Now()
+	table.pin("acme", "node1", now)
+
+	// lookups keep the entry alive until its absolute ttl
+	for elapsed := 30 * time.Second; elapsed < time.Hour; elapsed += 30 * time.Second {
+		id, ok := table.lookup("acme", now.Add(elapsed))
+		g.Expect(ok).To(gomega.BeTrue())
+		g.Expect(id).To(gomega.Equal("node1"))
+	}
+	_, ok := table.lookup("acme", now.Add(time.Hour+time.Second))
+	g.Expect(ok).To(gomega.BeFalse())
+
+	// idle entries are swept when new ones are pinned
+	table.pin("acme", "node1", now)
+	table.pin("globex", "node2", now.Add(2*time.Minute))
+	g.Expect(table.len()).To(gomega.Equal(1))
+}
+
+func TestAffinityTableMaxEntries(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	cfg := &AffinityConfig{Mode: AffinityHeader, Header: "X-Tenant-ID", MaxEntries: 2}
+	table, err := newAffinityTable(cfg)
+	g.Expect(err).To(gomega.BeNil())
+
+	now := time.Now()
+	table.pin("acme", "node1", now)
+	table.pin("globex", "node2", now)
+
+	// the lookup makes acme the most recently used entry
+	_, ok := table.lookup("acme", now)
+	g.Expect(ok).To(gomega.BeTrue())
+
+	table.pin("initech", "node3", now)
+	g.Expect(table.len()).To(gomega.Equal(2))
+
+	_, ok = table.lookup("globex", now)
+	g.Expect(ok).To(gomega.BeFalse())
+	for _, key := range []string{"acme", "initech"} {
+		_, ok = table.lookup(key, now)
+		g.Expect(ok).To(gomega.BeTrue())
+	}
+}
+
+func TestSelectServerByTable(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	lb, err := newServerNodes(serverConfigs([]string{"http://localhost:8081", "http://localhost:8082", "http://localhost:8083"}))
+	g.Expect(err).To(gomega.BeNil())
+	WithAffinity(AffinityConfig{Mode: AffinityHeader, Header: "X-Tenant-ID"})(lb)
+	g.Expect(lb.setupNodes()).To(gomega.BeNil())
+
+	request := func(tenant string) (*Node, *httptest.ResponseRecorder) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tenant != "" {
+			r.Header.Set("X-Tenant-ID", tenant)
+		}
+		w := httptest.NewRecorder()
+		node, err := lb.selectServer(w, r)
+		g.Expect(err).To(gomega.BeNil())
+		return node, w
+	}
+
+	acme, w := request("acme")
+	g.Expect(w.Result().Cookies()).To(gomega.BeEmpty())
+	globex, _ := request("globex")
+	g.Expect(globex).NotTo(gomega.BeIdenticalTo(acme))
+
+	// tenants stay on their node
+	for i := 0; i < 5; i++ {
+		node, _ := request("acme")
+		g.Expect(node).To(gomega.BeIdenticalTo(acme))
+	}
+
+	// requests without the header are not pinned
+	request("")
+	g.Expect(lb.table.len()).To(gomega.Equal(2))
+
+	// the tenant is remapped when its node goes down, and stays on the new node
+	acme.SetAlive(false)
+	remapped, _ := request("acme")
+	g.Expect(remapped).NotTo(gomega.BeIdenticalTo(acme))
+
+	acme.SetAlive(true)
+	node, _ := request("acme")
+	g.Expect(node).To(gomega.BeIdenticalTo(remapped))
+}
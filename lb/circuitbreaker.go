@@ -0,0 +1,215 @@
+package lb
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// Default circuit breaker settings.
+const (
+	defaultCircuitFailureThreshold = 5
+	defaultCircuitCooldown         = 30 * time.Second
+	defaultCircuitHalfOpenRequests = 1
+)
+
+// errCircuitOpen is the error of the requests refused by the circuit breaker of a node.
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitState is the state of the circuit breaker of a node.
+type CircuitState int
+
+// Circuit breaker states. A closed circuit lets every request through, an open circuit none,
+// and a half-open circuit a limited number of probe requests deciding whether it closes again.
+const (
+	CircuitClosed CircuitState = iota
+	CircuitOpen
+	CircuitHalfOpen
+)
+
+// String returns the name of the state.
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// CircuitBreakerConfig configures the circuit breaker of the nodes of a pool.
+// Connection failures, timeouts and 5xx responses count as failures. The circuit of a node
+// opens after FailureThreshold consecutive failures and stays open for Cooldown, then it lets
+// up to HalfOpenRequests probe requests through at a time. It closes once HalfOpenRequests
+// probes succeeded and opens again as soon as one fails.
+// Zero values fall back to 5 failures, 30 seconds and 1 probe request.
+type CircuitBreakerConfig struct {
+	FailureThreshold int      `json:"failure_threshold,omitempty"`
+	Cooldown         Duration `json:"cooldown,omitempty"`
+	HalfOpenRequests int      `json:"half_open_requests,omitempty"`
+}
+
+// validate checks the configuration and fills in the default values.
+func (cfg *CircuitBreakerConfig) validate() error {
+	if cfg.FailureThreshold < 0 || cfg.Cooldown < 0 || cfg.HalfOpenRequests < 0 {
+		return errors.New("circuit breaker settings can't be negative")
+	}
+
+	if cfg.FailureThreshold == 0 {
+		cfg.FailureThreshold = defaultCircuitFailureThreshold
+	}
+
+	if cfg.Cooldown == 0 {
+		cfg.Cooldown = Duration(defaultCircuitCooldown)
+	}
+
+	if cfg.HalfOpenRequests == 0 {
+		cfg.HalfOpenRequests = defaultCircuitHalfOpenRequests
+	}
+
+	return nil
+}
+
+// circuitBreaker tracks the outcome of the requests proxied to a node and decides whether
+// the node can take more requests.
+type circuitBreaker struct {
+	cfg       CircuitBreakerConfig
+	host      string
+	mux       sync.Mutex
+	state     CircuitState
+	failures  int
+	successes int
+	probes    int
+	openedAt  time.Time
+	// generation identifies the current half-open period, so probes started in a previous
+	// one don't release the slots of the current one
+	generation uint64
+}
+
+// newCircuitBreaker creates a closed circuit breaker for the node at host.
+// The configuration must have been validated.
+func newCircuitBreaker(cfg CircuitBreakerConfig, host string) *circuitBreaker {
+	return &circuitBreaker{
+		cfg:  cfg,
+		host: host,
+	}
+}
+
+// currentState returns the state of the circuit at now.
+// An open circuit whose cooldown is over is reported as half-open.
+func (cb *circuitBreaker) currentState(now time.Time) CircuitState {
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+
+	if cb.state == CircuitOpen && cb.cooledDown(now) {
+		return CircuitHalfOpen
+	}
+	return cb.state
+}
+
+// allows reports whether a request could be let through at now, without claiming a probe slot.
+func (cb *circuitBreaker) allows(now time.Time) bool {
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+
+	switch cb.state {
+	case CircuitOpen:
+		return cb.cooledDown(now)
+	case CircuitHalfOpen:
+		return cb.probes < cb.cfg.HalfOpenRequests
+	}
+	return true
+}
+
+// acquire claims the right to send a request at now. It returns false when the circuit refuses
+// the request. Requests let through a half-open circuit are probes, identified by a non zero
+// value that has to be given back to release once the request is over.
+func (cb *circuitBreaker) acquire(now time.Time) (uint64, bool) {
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+
+	if cb.state == CircuitOpen {
+		if !cb.cooledDown(now) {
+			return 0, false
+		}
+		cb.transition(CircuitHalfOpen, now)
+	}
+
+	if cb.state == CircuitHalfOpen {
+		if cb.probes >= cb.cfg.HalfOpenRequests {
+			return 0, false
+		}
+		cb.probes++
+		return cb.generation, true
+	}
+
+	return 0, true
+}
+
+// release frees the slot of a probe request once it is over.
+func (cb *circuitBreaker) release(probe uint64) {
+	if probe == 0 {
+		return
+	}
+
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+
+	if cb.state == CircuitHalfOpen && cb.generation == probe && cb.probes > 0 {
+		cb.probes--
+	}
+}
+
+// record feeds the outcome of a request proxied at now to the circuit breaker.
+func (cb *circuitBreaker) record(success bool, now time.Time) {
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+
+	switch cb.state {
+	case CircuitClosed:
+		if success {
+			cb.failures = 0
+			return
+		}
+		cb.failures++
+		if cb.failures >= cb.cfg.FailureThreshold {
+			cb.transition(CircuitOpen, now)
+		}
+	case CircuitHalfOpen:
+		if !success {
+			cb.transition(CircuitOpen, now)
+			return
+		}
+		cb.successes++
+		if cb.successes >= cb.cfg.HalfOpenRequests {
+			cb.transition(CircuitClosed, now)
+		}
+	}
+}
+
+// transition moves the circuit to state and logs it. The lock must be held.
+func (cb *circuitBreaker) transition(state CircuitState, now time.Time) {
+	log.Default().Printf("Circuit breaker of node '%s' %s -> %s", cb.host, cb.state, state)
+
+	cb.state = state
+	cb.failures = 0
+	cb.successes = 0
+	cb.probes = 0
+
+	switch state {
+	case CircuitOpen:
+		cb.openedAt = now
+	case CircuitHalfOpen:
+		cb.generation++
+	}
+}
+
+// cooledDown reports whether the cooldown of the open circuit is over at now.
+// The lock must be held.
+func (cb *circuitBreaker) cooledDown(now time.Time) bool {
+	return now.Sub(cb.openedAt) >= time.Duration(cb.cfg.Cooldown)
+}
@@ -0,0 +1,126 @@
+package lb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bsm/gomega"
+)
+
+func TestCircuitBreakerConfigValidate(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	testCases := []struct {
+		name        string
+		cfg         CircuitBreakerConfig
+		expectedCfg CircuitBreakerConfig
+		expectedErr bool
+	}{
+		{
+			name:        "defaults",
+			cfg:         CircuitBreakerConfig{},
+			expectedCfg: CircuitBreakerConfig{FailureThreshold: 5, Cooldown: Duration(30 * time.Second), HalfOpenRequests: 1},
+		},
+		{
+			name:        "custom",
+			cfg:         CircuitBreakerConfig{FailureThreshold: 2, Cooldown: Duration(time.Second), HalfOpenRequests: 3},
+			expectedCfg: CircuitBreakerConfig{FailureThreshold: 2, Cooldown: Duration(time.Second), HalfOpenRequests: 3},
+		},
+		{
+			name:        "negative threshold",
+			cfg:         CircuitBreakerConfig{FailureThreshold: -1},
+			expectedErr: true,
+		},
+		{
+			name:        "negative cooldown",
+			cfg:         CircuitBreakerConfig{Cooldown: Duration(-time.Second)},
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := tc.cfg
+			err := cfg.validate()
+
+			if tc.expectedErr {
+				g.Expect(err).NotTo(gomega.BeNil())
+			} else {
+				g.Expect(err).To(gomega.BeNil())
+				g.Expect(cfg).To(gomega.Equal(tc.expectedCfg))
+			}
+		})
+	}
+}
+
+func TestCircuitStateString(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	g.Expect(CircuitClosed.String()).To(gomega.Equal("closed"))
+	g.Expect(CircuitOpen.String()).To(gomega.Equal("open"))
+	g.Expect(CircuitHalfOpen.String()).To(gomega.Equal("half-open"))
+	g.Expect(CircuitState(42).String()).To(gomega.Equal("unknown"))
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	cfg := CircuitBreakerConfig{FailureThreshold: 3, Cooldown: Duration(10 * time.Second), HalfOpenRequests: 2}
+	g.Expect(cfg.validate()).To(gomega.BeNil())
+
+	cb := newCircuitBreaker(cfg, "localhost:8081")
+	now := time.Now()
+
+	// a success resets the consecutive failures
+	cb.record(false, now)
+	cb.record(false, now)
+	cb.record(true, now)
+	cb.record(false, now)
+	cb.record(false, now)
+	g.Expect(cb.currentState(now)).To(gomega.Equal(CircuitClosed))
+
+	cb.record(false, now)
+	g.Expect(cb.currentState(now)).To(gomega.Equal(CircuitOpen))
+	g.Expect(cb.allows(now)).To(gomega.BeFalse())
+
+	_, ok := cb.acquire(now.Add(5 * time.Second))
+	g.Expect(ok).To(gomega.BeFalse())
+
+	// after the cooldown only HalfOpenRequests probes are let through at a time
+	now = now.Add(10 * time.Second)
+	g.Expect(cb.currentState(now)).To(gomega.Equal(CircuitHalfOpen))
+	g.Expect(cb.allows(now)).To(gomega.BeTrue())
+
+	probe1, ok := cb.acquire(now)
+	g.Expect(ok).To(gomega.BeTrue())
+	probe2, ok := cb.acquire(now)
+	g.Expect(ok).To(gomega.BeTrue())
+	_, ok = cb.acquire(now)
+	g.Expect(ok).To(gomega.BeFalse())
+	g.Expect(cb.allows(now)).To(gomega.BeFalse())
+
+	// a probe finishing frees its slot
+	cb.record(true, now)
+	cb.release(probe1)
+	g.Expect(cb.allows(now)).To(gomega.BeTrue())
+	g.Expect(cb.currentState(now)).To(gomega.Equal(CircuitHalfOpen))
+
+	// a failed probe opens the circuit again
+	cb.record(false, now)
+	cb.release(probe2)
+	g.Expect(cb.currentState(now)).To(gomega.Equal(CircuitOpen))
+
+	// enough successful probes close it
+	now = now.Add(10 * time.Second)
+	for i := 0; i < 2; i++ {
+		probe, ok := cb.acquire(now)
+		g.Expect(ok).To(gomega.BeTrue())
+		cb.record(true, now)
+		cb.release(probe)
+	}
+	g.Expect(cb.currentState(now)).To(gomega.Equal(CircuitClosed))
+
+	// a stale probe doesn't release anything once the circuit moved on
+	cb.release(probe1)
+	g.Expect(cb.probes).To(gomega.Equal(0))
+}
@@ -0,0 +1,223 @@
+package lb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Config is the configuration of a load balancer pool.
+// In JSON it is either the list of servers alone or an object holding the servers
+// together with the optional settings of the pool, e.g.
+//
+//	{"servers": ["http://localhost:8081"], "health_check": {"path": "/health"}}
+type Config struct {
+	Servers          []ServerConfig          `json:"servers"`
+	Strategy         *StrategyConfig         `json:"strategy,omitempty"`
+	HealthCheck      *HealthCheckConfig      `json:"health_check,omitempty"`
+	OutlierDetection *OutlierDetectionConfig `json:"outlier_detection,omitempty"`
+	Retry            *RetryConfig            `json:"retry,omitempty"`
+	CircuitBreaker   *CircuitBreakerConfig   `json:"circuit_breaker,omitempty"`
+	SlowStart        *SlowStartConfig        `json:"slow_start,omitempty"`
+	Drain            *DrainConfig            `json:"drain,omitempty"`
+	Affinity         *AffinityConfig         `json:"affinity,omitempty"`
+}
+
+// UnmarshalJSON decodes a configuration given either as a list of servers or as an object.
+func (c *Config) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		servers, err := ParseServerList(data)
+		if err != nil {
+			return err
+		}
+
+		*c = Config{Servers: servers}
+		return nil
+	}
+
+	// decode through an alias so the object form doesn't recurse into this method
+	type config Config
+	var cfg config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return err
+	}
+
+	*c = Config(cfg)
+
+	return nil
+}
+
+// ParseConfig decodes and validates a JSON configuration.
+func ParseConfig(data []byte) (*Config, error) {
+	cfg := &Config{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+
+	if len(cfg.Servers) == 0 {
+		return nil, errors.New("at least one server is required")
+	}
+
+	return cfg, nil
+}
+
+// Options returns the load balancer options matching the optional settings of the configuration.
+func (c *Config) Options() ([]Option, error) {
+	opts := []Option{}
+
+	if c.Strategy != nil {
+		strategy, err := c.Strategy.newStrategy()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithStrategy(strategy))
+	}
+
+	if c.HealthCheck != nil {
+		hc, err := NewHealthCheck(*c.HealthCheck)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithHealthCheck(hc))
+	}
+
+	if c.OutlierDetection != nil {
+		cfg := *c.OutlierDetection
+		if err := cfg.validate(); err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithOutlierDetection(cfg))
+	}
+
+	if c.Retry != nil {
+		cfg := *c.Retry
+		if err := cfg.validate(); err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithRetry(cfg))
+	}
+
+	if c.CircuitBreaker != nil {
+		cfg := *c.CircuitBreaker
+		if err := cfg.validate(); err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithCircuitBreaker(cfg))
+	}
+
+	if c.SlowStart != nil {
+		cfg := *c.SlowStart
+		if err := cfg.validate(); err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithSlowStart(cfg))
+	}
+
+	if c.Drain != nil {
+		cfg := *c.Drain
+		if err := cfg.validate(); err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithDrain(cfg))
+	}
+
+	if c.Affinity != nil {
+		cfg := *c.Affinity
+		if err := cfg.validate(); err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithAffinity(cfg))
+	}
+
+	return opts, nil
+}
+
+// Duration is a time.Duration that is written in JSON as a string such as "1.5s" or "300ms".
+type Duration time.Duration
+
+// UnmarshalJSON decodes a duration string.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("invalid duration %s", data)
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(duration)
+
+	return nil
+}
+
+// MarshalJSON encodes the duration as a string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// ServerConfig describes an origin server of the pool.
+// In JSON it is either a plain URL string or an object with the URL, its base weight and
+// the health check settings it overrides, e.g. "http://localhost:8081" or
+// {"url": "http://localhost:8081", "weight": 3, "health_check": {"interval": "30s"}}.
+type ServerConfig struct {
+	URL         string             `json:"url"`
+	Weight      float64            `json:"weight,omitempty"`
+	HealthCheck *HealthCheckConfig `json:"health_check,omitempty"`
+}
+
+// UnmarshalJSON decodes a server given either as a URL string or as an object.
+// A missing weight defaults to 1.
+func (s *ServerConfig) UnmarshalJSON(data []byte) error {
+	var url string
+	if err := json.Unmarshal(data, &url); err == nil {
+		*s = ServerConfig{URL: url, Weight: 1}
+		return nil
+	}
+
+	// decode through an alias so the object form doesn't recurse into this method
+	type serverConfig ServerConfig
+	var server serverConfig
+	if err := json.Unmarshal(data, &server); err != nil {
+		return err
+	}
+
+	if server.URL == "" {
+		return errors.New("server url is required")
+	}
+
+	if server.Weight < 0 {
+		return fmt.Errorf("server '%s' has a negative weight", server.URL)
+	}
+
+	if server.Weight == 0 {
+		server.Weight = 1
+	}
+
+	*s = ServerConfig(server)
+
+	return nil
+}
+
+// ParseServerList decodes a JSON list of servers where each entry is either a URL string
+// or an object with the URL and its weight.
+func ParseServerList(data []byte) ([]ServerConfig, error) {
+	var servers []ServerConfig
+	if err := json.Unmarshal(data, &servers); err != nil {
+		return nil, err
+	}
+
+	return servers, nil
+}
+
+// serverConfigs turns a list of URLs into servers with the default weight of 1.
+func serverConfigs(urls []string) []ServerConfig {
+	servers := make([]ServerConfig, 0, len(urls))
+	for _, url := range urls {
+		servers = append(servers, ServerConfig{URL: url, Weight: 1})
+	}
+	return servers
+}
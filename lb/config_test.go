@@ -0,0 +1,279 @@
+package lb
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bsm/gomega"
+)
+
+func TestParseServerList(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	testCases := []struct {
+		name            string
+		data            string
+		expectedServers []ServerConfig
+		expectedErr     error
+	}{
+		{
+			name: "plain url strings",
+			data: `["http://localhost:8081", "http://localhost:8082"]`,
+			expectedServers: []ServerConfig{
+				{URL: "http://localhost:8081", Weight: 1},
+				{URL: "http://localhost:8082", Weight: 1},
+			},
+		},
+		{
+			name: "objects with weights mixed with strings",
+			data: `[{"url": "http://localhost:8081", "weight": 3}, {"url": "http://localhost:8082"}, "http://localhost:8083"]`,
+			expectedServers: []ServerConfig{
+				{URL: "http://localhost:8081", Weight: 3},
+				{URL: "http://localhost:8082", Weight: 1},
+				{URL: "http://localhost:8083", Weight: 1},
+			},
+		},
+		{
+			name: "object with a health check override",
+			data: `[{"url": "http://localhost:8081", "health_check": {"interval": "30s"}}]`,
+			expectedServers: []ServerConfig{
+				{URL: "http://localhost:8081", Weight: 1, HealthCheck: &HealthCheckConfig{Interval: Duration(30 * time.Second)}},
+			},
+		},
+		{
+			name:        "object without url",
+			data:        `[{"weight": 3}]`,
+			expectedErr: errors.New("server url is required"),
+		},
+		{
+			name:        "negative weight",
+			data:        `[{"url": "http://localhost:8081", "weight": -1}]`,
+			expectedErr: errors.New("server 'http://localhost:8081' has a negative weight"),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			servers, err := ParseServerList([]byte(tc.data))
+
+			if tc.expectedErr != nil {
+				g.Expect(err).To(gomega.Equal(tc.expectedErr))
+			} else {
+				g.Expect(err).To(gomega.BeNil())
+				g.Expect(servers).To(gomega.Equal(tc.expectedServers))
+			}
+		})
+	}
+}
+
+func TestNewServerNodesWeights(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	lb, err := newServerNodes([]ServerConfig{
+		{URL: "http://localhost:8081", Weight: 3},
+		{URL: "http://localhost:8082"},
+	})
+
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(lb.Nodes[0].Weight()).To(gomega.Equal(float64(3)))
+	g.Expect(lb.Nodes[0].BaseWeight()).To(gomega.Equal(float64(3)))
+	g.Expect(lb.Nodes[1].Weight()).To(gomega.Equal(float64(1)))
+	g.Expect(lb.Nodes[1].BaseWeight()).To(gomega.Equal(float64(1)))
+}
+
+func TestParseConfig(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	testCases := []struct {
+		name           string
+		data           string
+		expectedConfig *Config
+		expectedErr    bool
+	}{
+		{
+			name: "list of servers",
+			data: `["http://localhost:8081", {"url": "http://localhost:8082", "weight": 2}]`,
+			expectedConfig: &Config{Servers: []ServerConfig{
+				{URL: "http://localhost:8081", Weight: 1},
+				{URL: "http://localhost:8082", Weight: 2},
+			}},
+		},
+		{
+			name: "object with health check",
+			data: `{"servers": ["http://localhost:8081"], "health_check": {"path": "/health", "expected_status": [200, "3xx"], "timeout": "500ms"}}`,
+			expectedConfig: &Config{
+				Servers: []ServerConfig{{URL: "http://localhost:8081", Weight: 1}},
+				HealthCheck: &HealthCheckConfig{
+					Path:           "/health",
+					ExpectedStatus: []StatusRange{{Min: 200, Max: 200}, {Min: 300, Max: 399}},
+					Timeout:        Duration(500 * time.Millisecond),
+				},
+			},
+		},
+		{
+			name: "object with outlier detection",
+			data: `{"servers": ["http://localhost:8081"], "outlier_detection": {"max_failures": 3, "ejection_time": "1m"}}`,
+			expectedConfig: &Config{
+				Servers:          []ServerConfig{{URL: "http://localhost:8081", Weight: 1}},
+				OutlierDetection: &OutlierDetectionConfig{MaxFailures: 3, EjectionTime: Duration(time.Minute)},
+			},
+		},
+		{
+			name:        "no servers",
+			data:        `{"servers": []}`,
+			expectedErr: true,
+		},
+		{
+			name:        "invalid duration",
+			data:        `{"servers": ["http://localhost:8081"], "health_check": {"timeout": "soon"}}`,
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := ParseConfig([]byte(tc.data))
+
+			if tc.expectedErr {
+				g.Expect(err).NotTo(gomega.BeNil())
+			} else {
+				g.Expect(err).To(gomega.BeNil())
+				g.Expect(cfg).To(gomega.Equal(tc.expectedConfig))
+			}
+		})
+	}
+}
+
+func TestConfigOptions(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	cfg := &Config{HealthCheck: &HealthCheckConfig{Path: "/health"}}
+	opts, err := cfg.Options()
+	g.Expect(err).To(gomega.BeNil())
+
+	lb := &LB{}
+	for _, opt := range opts {
+		opt(lb)
+	}
+	g.Expect(lb.healthCheck).NotTo(gomega.BeNil())
+	g.Expect(lb.healthCheck.path).To(gomega.Equal("/health"))
+
+	cfg = &Config{HealthCheck: &HealthCheckConfig{BodyRegex: "("}}
+	_, err = cfg.Options()
+	g.Expect(err).NotTo(gomega.BeNil())
+
+	cfg = &Config{OutlierDetection: &OutlierDetectionConfig{MaxFailures: 3}}
+	opts, err = cfg.Options()
+	g.Expect(err).To(gomega.BeNil())
+
+	lb = &LB{}
+	for _, opt := range opts {
+		opt(lb)
+	}
+	g.Expect(lb.outlierDetection.MaxFailures).To(gomega.Equal(3))
+	g.Expect(lb.outlierDetection.Window).To(gomega.Equal(Duration(defaultOutlierWindow)))
+
+	cfg = &Config{OutlierDetection: &OutlierDetectionConfig{FailureRatio: 2}}
+	_, err = cfg.Options()
+	g.Expect(err).NotTo(gomega.BeNil())
+
+	cfg = &Config{Retry: &RetryConfig{MaxAttempts: 2, Methods: []string{"PUT"}}}
+	opts, err = cfg.Options()
+	g.Expect(err).To(gomega.BeNil())
+
+	lb = &LB{}
+	for _, opt := range opts {
+		opt(lb)
+	}
+	g.Expect(lb.retry.MaxAttempts).To(gomega.Equal(2))
+	g.Expect(lb.retry.MaxBodySize).To(gomega.Equal(int64(defaultRetryMaxBodySize)))
+
+	cfg = &Config{Retry: &RetryConfig{MaxAttempts: -1}}
+	_, err = cfg.Options()
+	g.Expect(err).NotTo(gomega.BeNil())
+
+	cfg = &Config{CircuitBreaker: &CircuitBreakerConfig{FailureThreshold: 2}}
+	opts, err = cfg.Options()
+	g.Expect(err).To(gomega.BeNil())
+
+	lb = &LB{}
+	for _, opt := range opts {
+		opt(lb)
+	}
+	g.Expect(lb.circuitBreaker.FailureThreshold).To(gomega.Equal(2))
+	g.Expect(lb.circuitBreaker.HalfOpenRequests).To(gomega.Equal(1))
+
+	cfg = &Config{CircuitBreaker: &CircuitBreakerConfig{Cooldown: Duration(-time.Second)}}
+	_, err = cfg.Options()
+	g.Expect(err).NotTo(gomega.BeNil())
+
+	cfg = &Config{SlowStart: &SlowStartConfig{Window: Duration(time.Minute)}}
+	opts, err = cfg.Options()
+	g.Expect(err).To(gomega.BeNil())
+
+	lb = &LB{}
+	for _, opt := range opts {
+		opt(lb)
+	}
+	g.Expect(lb.slowStart.Window).To(gomega.Equal(Duration(time.Minute)))
+	g.Expect(lb.slowStart.MinWeightRatio).To(gomega.Equal(defaultSlowStartMinWeightRatio))
+
+	cfg = &Config{SlowStart: &SlowStartConfig{MinWeightRatio: 2}}
+	_, err = cfg.Options()
+	g.Expect(err).NotTo(gomega.BeNil())
+
+	cfg = &Config{Drain: &DrainConfig{KeepSessions: true}}
+	opts, err = cfg.Options()
+	g.Expect(err).To(gomega.BeNil())
+
+	lb = &LB{}
+	for _, opt := range opts {
+		opt(lb)
+	}
+	g.Expect(lb.drain.KeepSessions).To(gomega.BeTrue())
+
+	cfg = &Config{Affinity: &AffinityConfig{Keys: []string{"secret"}}}
+	opts, err = cfg.Options()
+	g.Expect(err).To(gomega.BeNil())
+
+	lb = &LB{}
+	for _, opt := range opts {
+		opt(lb)
+	}
+	g.Expect(lb.affinity.Keys).To(gomega.Equal([]string{"secret"}))
+
+	cfg = &Config{Affinity: &AffinityConfig{Keys: []string{""}}}
+	_, err = cfg.Options()
+	g.Expect(err).NotTo(gomega.BeNil())
+
+	cfg, err = ParseConfig([]byte(`{"servers": ["http://localhost:8081"], "affinity": {"cookie": {"name": "lb", "same_site": "lax", "http_only": true}, "idle_ttl": "30m"}}`))
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(cfg.Affinity.Cookie).To(gomega.Equal(CookieConfig{Name: "lb", SameSite: "lax", HTTPOnly: true}))
+	g.Expect(cfg.Affinity.IdleTTL).To(gomega.Equal(Duration(30 * time.Minute)))
+
+	cfg = &Config{Affinity: &AffinityConfig{Mode: AffinityHeader}}
+	_, err = cfg.Options()
+	g.Expect(err).NotTo(gomega.BeNil())
+
+	cfg, err = ParseConfig([]byte(`{"servers": ["http://localhost:8081"], "affinity": {"mode": "ip", "trusted_proxies": ["10.0.0.0/8"], "failback": true}}`))
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(cfg.Affinity.Mode).To(gomega.Equal(AffinityIP))
+	g.Expect(cfg.Affinity.TrustedProxies).To(gomega.Equal([]string{"10.0.0.0/8"}))
+	g.Expect(cfg.Affinity.Failback).To(gomega.BeTrue())
+
+	cfg, err = ParseConfig([]byte(`{"servers": ["http://localhost:8081"], "strategy": {"name": "consistent_hash", "hash_key": "header:X-User"}}`))
+	g.Expect(err).To(gomega.BeNil())
+	opts, err = cfg.Options()
+	g.Expect(err).To(gomega.BeNil())
+
+	lb = &LB{}
+	for _, opt := range opts {
+		opt(lb)
+	}
+	g.Expect(lb.strategy).To(gomega.BeAssignableToTypeOf(&ConsistentHash{}))
+
+	cfg = &Config{Strategy: &StrategyConfig{Name: "fastest"}}
+	_, err = cfg.Options()
+	g.Expect(err).NotTo(gomega.BeNil())
+}
@@ -0,0 +1,51 @@
+package lb
+
+import (
+	"errors"
+	"time"
+)
+
+// defaultDrainTimeout is how long nodes removed from the configuration are drained by default.
+const defaultDrainTimeout = 30 * time.Second
+
+// DrainConfig configures how draining nodes are handled.
+// By default a draining node takes no new request at all. With KeepSessions, clients
+// whose session cookie pins them to a draining node keep being sent to it, only new
+// sessions go to the other nodes.
+// Nodes removed from the configuration on reload are drained and removed once no request
+// is in flight anymore, or after Timeout (30 seconds by default).
+type DrainConfig struct {
+	KeepSessions bool     `json:"keep_sessions,omitempty"`
+	Timeout      Duration `json:"timeout,omitempty"`
+}
+
+// validate checks the configuration and fills in the default values.
+func (cfg *DrainConfig) validate() error {
+	if cfg.Timeout < 0 {
+		return errors.New("drain timeout can't be negative")
+	}
+
+	if cfg.Timeout == 0 {
+		cfg.Timeout = Duration(defaultDrainTimeout)
+	}
+
+	return nil
+}
+
+// acceptsSession returns whether the node can serve a request of a session pinned to it.
+func (lb *LB) acceptsSession(n *Node) bool {
+	if lb.drain != nil && lb.drain.KeepSessions && n.IsDraining() {
+		return n.serving()
+	}
+
+	return n.Available()
+}
+
+// drainTimeout returns how long nodes removed from the configuration are drained.
+func (lb *LB) drainTimeout() time.Duration {
+	if lb.drain != nil && lb.drain.Timeout > 0 {
+		return time.Duration(lb.drain.Timeout)
+	}
+
+	return defaultDrainTimeout
+}
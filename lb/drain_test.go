@@ -0,0 +1,157 @@
+package lb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bsm/gomega"
+)
+
+func TestNodeDrain(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	defer testServer.Close()
+
+	node, err := newNode(ServerConfig{URL: testServer.URL})
+	g.Expect(err).To(gomega.BeNil())
+
+	served := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		node.proxy(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		served <- w.Code
+	}()
+	<-started
+
+	// the request in flight keeps running while the node is draining
+	drained := node.Drain()
+	g.Expect(node.IsDraining()).To(gomega.BeTrue())
+	g.Expect(node.Available()).To(gomega.BeFalse())
+	g.Expect(node.IsDrained()).To(gomega.BeFalse())
+	g.Consistently(drained, 50*time.Millisecond).ShouldNot(gomega.BeClosed())
+
+	close(release)
+	g.Expect(<-served).To(gomega.Equal(http.StatusOK))
+	g.Eventually(drained).Should(gomega.BeClosed())
+	g.Expect(node.IsDrained()).To(gomega.BeTrue())
+
+	// draining an idle node is done right away, and it can be put back in rotation
+	node.SetDraining(false)
+	g.Expect(node.Available()).To(gomega.BeTrue())
+	g.Expect(node.IsDrained()).To(gomega.BeFalse())
+	g.Expect(node.Drain()).To(gomega.BeClosed())
+}
+
+func TestSelectServerByCookieDraining(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	testCases := []struct {
+		name         string
+		drain        *DrainConfig
+		expectedNode int
+	}{
+		{
+			name:         "sessions are moved by default",
+			expectedNode: 1,
+		},
+		{
+			name:         "sessions are moved",
+			drain:        &DrainConfig{},
+			expectedNode: 1,
+		},
+		{
+			name:         "sessions are kept",
+			drain:        &DrainConfig{KeepSessions: true},
+			expectedNode: 0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			lb, err := newServerNodes(serverConfigs([]string{"http://localhost:8081", "http://localhost:8082"}))
+			g.Expect(err).To(gomega.BeNil())
+			if tc.drain != nil {
+				WithDrain(*tc.drain)(lb)
+			}
+
+			lb.Nodes[0].SetDraining(true)
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.AddCookie(&http.Cookie{Name: "session", Value: sessionValue(lb.cookieSigner(), lb.Nodes[0])})
+			node, err := lb.selectServer(httptest.NewRecorder(), r)
+
+			g.Expect(err).To(gomega.BeNil())
+			g.Expect(node).To(gomega.BeIdenticalTo(lb.Nodes[tc.expectedNode]))
+
+			// new sessions never go to the draining node
+			node, err = lb.selectServer(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+			g.Expect(err).To(gomega.BeNil())
+			g.Expect(node).To(gomega.BeIdenticalTo(lb.Nodes[1]))
+		})
+	}
+}
+
+func TestProxyNodeDrainedAfterSelection(t *testing.T) {
+	testCases := []struct {
+		name  string
+		retry *RetryConfig
+	}{
+		{name: "without retry"},
+		{name: "with retry", retry: &RetryConfig{}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			g := gomega.NewGomegaWithT(t)
+
+			var hits [2]int32
+			servers := make([]string, 2)
+			for i := range servers {
+				i := i
+				server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					atomic.AddInt32(&hits[i], 1)
+				}))
+				defer server.Close()
+				servers[i] = server.URL
+			}
+
+			lb, err := newServerNodes(serverConfigs(servers))
+			g.Expect(err).To(gomega.BeNil())
+			lb.strategy = firstNodeStrategy{}
+			if tc.retry != nil {
+				WithRetry(*tc.retry)(lb)
+			}
+			g.Expect(lb.setupNodes()).To(gomega.BeNil())
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			node, err := lb.selectServer(w, r)
+			g.Expect(err).To(gomega.BeNil())
+			g.Expect(node).To(gomega.BeIdenticalTo(lb.Nodes[0]))
+
+			// the node is drained once selected, before the request is proxied
+			drained := node.Drain()
+			g.Expect(drained).To(gomega.BeClosed())
+
+			if tc.retry != nil {
+				lb.serveWithRetry(w, r, node, lb.retry)
+			} else {
+				lb.proxy(w, r, node)
+			}
+
+			g.Expect(w.Code).To(gomega.Equal(http.StatusOK))
+			g.Expect(atomic.LoadInt32(&hits[0])).To(gomega.Equal(int32(0)))
+			g.Expect(atomic.LoadInt32(&hits[1])).To(gomega.Equal(int32(1)))
+			g.Expect(node.InFlight()).To(gomega.Equal(int64(0)))
+		})
+	}
+}
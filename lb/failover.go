@@ -0,0 +1,49 @@
+package lb
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"time"
+)
+
+// newSessionID returns a random ID for a new session.
+func newSessionID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		// the time is unique enough to spread the sessions over the nodes
+		binary.BigEndian.PutUint64(id, uint64(time.Now().UnixNano()))
+	}
+	return hex.EncodeToString(id)
+}
+
+// rendezvousNode returns the available node with the highest score for the key by
+// rendezvous hashing, or nil when no node is available. Removing a node only moves the
+// keys it had, and they land on the same nodes on every instance of the load balancer.
+func rendezvousNode(key string, nodes []*Node) *Node {
+	var best *Node
+	var bestScore uint64
+	for _, node := range nodes {
+		if !node.Available() {
+			continue
+		}
+
+		score := hash64(key + "\x00" + node.URL.String())
+		if best == nil || score > bestScore || (score == bestScore && node.URL.String() < best.URL.String()) {
+			best, bestScore = node, score
+		}
+	}
+
+	return best
+}
+
+// failoverNode returns the node taking over the session with the given ID while the node it
+// is pinned to can't serve it.
+func (lb *LB) failoverNode(sessionID string) (*Node, error) {
+	node := rendezvousNode(sessionID, lb.nodes())
+	if node == nil {
+		return nil, ErrNoAvailableNode
+	}
+
+	return node, nil
+}
@@ -0,0 +1,155 @@
+package lb
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/bsm/gomega"
+)
+
+func TestRendezvousNode(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	// URLs differing only by their last character and keys such as client IPs must still
+	// spread evenly
+	nodes := []*Node{}
+	for i := 1; i <= 5; i++ {
+		nodes = append(nodes, &Node{URL: &url.URL{Scheme: "http", Host: fmt.Sprintf("localhost:808%d", i)}, alive: true, weight: 1})
+	}
+	keys := map[string]*Node{}
+	owned := map[*Node]int{}
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		keys[key] = rendezvousNode(key, nodes)
+		owned[keys[key]]++
+	}
+	for _, node := range nodes {
+		g.Expect(owned[node]).To(gomega.BeNumerically("~", 2000, 250), node.URL.String())
+	}
+
+	// only the keys of a failed node move, and they are spread evenly over the other nodes
+	failed := nodes[2]
+	failed.SetAlive(false)
+
+	moved := map[*Node]int{}
+	for key, node := range keys {
+		replacement := rendezvousNode(key, nodes)
+		if node != failed {
+			g.Expect(replacement).To(gomega.BeIdenticalTo(node))
+			continue
+		}
+		g.Expect(replacement).NotTo(gomega.BeIdenticalTo(failed))
+		g.Expect(rendezvousNode(key, nodes)).To(gomega.BeIdenticalTo(replacement))
+		moved[replacement]++
+	}
+	g.Expect(moved).To(gomega.HaveLen(4))
+	for node, count := range moved {
+		g.Expect(count).To(gomega.BeNumerically("~", owned[failed]/4, owned[failed]/10), node.URL.String())
+	}
+
+	// the order of the nodes doesn't matter
+	reversed := []*Node{nodes[4], nodes[3], nodes[2], nodes[1], nodes[0]}
+	for key := range keys {
+		g.Expect(rendezvousNode(key, reversed)).To(gomega.BeIdenticalTo(rendezvousNode(key, nodes)))
+	}
+
+	for _, n := range nodes {
+		n.SetAlive(false)
+	}
+	g.Expect(rendezvousNode("10.0.0.1", nodes)).To(gomega.BeNil())
+}
+
+func TestSelectServerByCookieFailover(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	testCases := []struct {
+		name     string
+		failback bool
+	}{
+		{
+			name: "sessions stay on their new node",
+		},
+		{
+			name:     "sessions go back to their node",
+			failback: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			lb, err := newServerNodes(serverConfigs([]string{"http://localhost:8081", "http://localhost:8082", "http://localhost:8083"}))
+			g.Expect(err).To(gomega.BeNil())
+			WithAffinity(AffinityConfig{Keys: []string{"secret"}, Failback: tc.failback})(lb)
+			g.Expect(lb.setupNodes()).To(gomega.BeNil())
+
+			now := time.Now()
+			cookie := &http.Cookie{Name: "session", Value: lb.cookieSigner().sign(session{id: "s1", nodeID: lb.cookieSigner().nodeID(lb.Nodes[0].URL), created: now, seen: now}.encode())}
+			request := func() (*Node, []*http.Cookie) {
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				r.AddCookie(cookie)
+				w := httptest.NewRecorder()
+				node, err := lb.selectServer(w, r)
+				g.Expect(err).To(gomega.BeNil())
+				return node, w.Result().Cookies()
+			}
+
+			// the session fails over to the node picked by its ID, every time
+			lb.Nodes[0].SetAlive(false)
+			replacement := rendezvousNode("s1", lb.Nodes)
+			for i := 0; i < 5; i++ {
+				node, cookies := request()
+				g.Expect(node).To(gomega.BeIdenticalTo(replacement))
+
+				if len(cookies) > 0 {
+					s, ok := lb.readSession(cookies[0].Value, time.Now())
+					g.Expect(ok).To(gomega.BeTrue())
+					g.Expect(s.id).To(gomega.Equal("s1"))
+					cookie = cookies[0]
+				}
+			}
+
+			lb.Nodes[0].SetAlive(true)
+			node, _ := request()
+			if tc.failback {
+				g.Expect(node).To(gomega.BeIdenticalTo(lb.Nodes[0]))
+			} else {
+				g.Expect(node).To(gomega.BeIdenticalTo(replacement))
+			}
+		})
+	}
+}
+
+func TestSelectServerByTableFailover(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	for _, failback := range []bool{false, true} {
+		lb, err := newServerNodes(serverConfigs([]string{"http://localhost:8081", "http://localhost:8082", "http://localhost:8083"}))
+		g.Expect(err).To(gomega.BeNil())
+		WithAffinity(AffinityConfig{Mode: AffinityHeader, Header: "X-Tenant-ID", Failback: failback})(lb)
+		g.Expect(lb.setupNodes()).To(gomega.BeNil())
+
+		request := func() *Node {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("X-Tenant-ID", "acme")
+			node, err := lb.selectServer(httptest.NewRecorder(), r)
+			g.Expect(err).To(gomega.BeNil())
+			return node
+		}
+
+		pinned := request()
+		pinned.SetAlive(false)
+		replacement := request()
+		g.Expect(replacement).To(gomega.BeIdenticalTo(rendezvousNode("acme", lb.Nodes)))
+
+		pinned.SetAlive(true)
+		if failback {
+			g.Expect(request()).To(gomega.BeIdenticalTo(pinned))
+		} else {
+			g.Expect(request()).To(gomega.BeIdenticalTo(replacement))
+		}
+	}
+}
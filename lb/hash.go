@@ -0,0 +1,183 @@
+package lb
+
+import (
+	"hash/fnv"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// defaultReplicas is the number of virtual nodes placed on the ring for every node
+// when no explicit number is given to NewConsistentHash.
+const defaultReplicas = 100
+
+// HashKeyFunc extracts the key used to place a request on the consistent hash ring.
+type HashKeyFunc func(r *http.Request) string
+
+// HashByClientIP uses the IP address of the client as the hash key.
+func HashByClientIP() HashKeyFunc {
+	return clientIP
+}
+
+// HashByHeader uses the value of the given request header as the hash key.
+func HashByHeader(name string) HashKeyFunc {
+	return func(r *http.Request) string {
+		return r.Header.Get(name)
+	}
+}
+
+// HashByQuery uses the value of the given query parameter as the hash key.
+func HashByQuery(param string) HashKeyFunc {
+	return func(r *http.Request) string {
+		return r.URL.Query().Get(param)
+	}
+}
+
+// HashByPath uses the URL path of the request as the hash key.
+func HashByPath() HashKeyFunc {
+	return func(r *http.Request) string {
+		return r.URL.Path
+	}
+}
+
+// clientIP returns the IP address of the client that sent the request.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ConsistentHash is a Strategy that places every node on a hash ring several times
+// (virtual nodes) and sends a request to the first alive node found walking the ring
+// clockwise from the hash of the request key. Adding or removing a node only remaps
+// the keys that fall on its share of the ring.
+type ConsistentHash struct {
+	key      HashKeyFunc
+	replicas int
+	mux      sync.Mutex
+	ring     *hashRing
+}
+
+// hashRing is an immutable ring built for a given set of nodes.
+type hashRing struct {
+	members map[*Node]struct{}
+	hashes  []uint64
+	owners  map[uint64]*Node
+}
+
+// NewConsistentHash creates a new consistent hash strategy that hashes requests by key,
+// placing replicas virtual nodes per node on the ring. A replicas value lower than 1
+// falls back to the default of 100. Requests with an empty key are hashed by client IP.
+func NewConsistentHash(key HashKeyFunc, replicas int) *ConsistentHash {
+	if replicas < 1 {
+		replicas = defaultReplicas
+	}
+
+	return &ConsistentHash{
+		key:      key,
+		replicas: replicas,
+	}
+}
+
+// Select returns the first alive node on the ring at or after the hash of the request key.
+func (ch *ConsistentHash) Select(nodes []*Node, r *http.Request) (*Node, error) {
+	ring := ch.getRing(nodes)
+	if len(ring.hashes) == 0 {
+		return nil, ErrNoAvailableNode
+	}
+
+	key := ch.key(r)
+	if key == "" {
+		key = clientIP(r)
+	}
+
+	hash := hash64(key)
+	start := sort.Search(len(ring.hashes), func(i int) bool {
+		return ring.hashes[i] >= hash
+	})
+
+	for i := 0; i < len(ring.hashes); i++ {
+		node := ring.owners[ring.hashes[(start+i)%len(ring.hashes)]]
+		if selectable(node, r) {
+			return node, nil
+		}
+	}
+
+	return nil, ErrNoAvailableNode
+}
+
+// getRing returns the ring for the given nodes, rebuilding it only when the set of nodes changed.
+func (ch *ConsistentHash) getRing(nodes []*Node) *hashRing {
+	ch.mux.Lock()
+	defer ch.mux.Unlock()
+
+	if ch.ring != nil && ch.ring.hasMembers(nodes) {
+		return ch.ring
+	}
+
+	ring := &hashRing{
+		members: make(map[*Node]struct{}, len(nodes)),
+		hashes:  make([]uint64, 0, len(nodes)*ch.replicas),
+		owners:  make(map[uint64]*Node, len(nodes)*ch.replicas),
+	}
+
+	for _, node := range nodes {
+		ring.members[node] = struct{}{}
+		for i := 0; i < ch.replicas; i++ {
+			hash := hash64(node.URL.String() + "#" + strconv.Itoa(i))
+			if owner, ok := ring.owners[hash]; ok {
+				// resolve collisions by URL so the ring doesn't depend on the order of the nodes
+				if owner.URL.String() > node.URL.String() {
+					ring.owners[hash] = node
+				}
+				continue
+			}
+			ring.owners[hash] = node
+			ring.hashes = append(ring.hashes, hash)
+		}
+	}
+
+	sort.Slice(ring.hashes, func(i, j int) bool {
+		return ring.hashes[i] < ring.hashes[j]
+	})
+
+	ch.ring = ring
+
+	return ring
+}
+
+// hash64 returns a 64-bit hash of s whose bits all depend on every byte of s, so that
+// keys and URLs differing only by their last characters still spread evenly: FNV-1a alone
+// leaves them close to each other, so its sum is put through the splitmix64 finalizer.
+func hash64(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+
+	return x
+}
+
+// hasMembers reports whether the ring was built for exactly the given nodes.
+func (ring *hashRing) hasMembers(nodes []*Node) bool {
+	if len(ring.members) != len(nodes) {
+		return false
+	}
+
+	for _, node := range nodes {
+		if _, ok := ring.members[node]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,165 @@
+package lb
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/bsm/gomega"
+)
+
+func newHashTestNodes(count int) []*Node {
+	nodes := []*Node{}
+	for i := 0; i < count; i++ {
+		nodes = append(nodes, &Node{URL: &url.URL{Scheme: "http", Host: fmt.Sprintf("10.0.0.%d:8080", i)}, alive: true, weight: 1})
+	}
+	return nodes
+}
+
+func TestHashKeyFunc(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/users/42?tenant=acme", nil)
+	r.RemoteAddr = "192.168.1.10:51234"
+	r.Header.Set("X-User", "alice")
+
+	testCases := []struct {
+		name        string
+		key         HashKeyFunc
+		expectedKey string
+	}{
+		{
+			name:        "client ip",
+			key:         HashByClientIP(),
+			expectedKey: "192.168.1.10",
+		},
+		{
+			name:        "header",
+			key:         HashByHeader("X-User"),
+			expectedKey: "alice",
+		},
+		{
+			name:        "query parameter",
+			key:         HashByQuery("tenant"),
+			expectedKey: "acme",
+		},
+		{
+			name:        "path",
+			key:         HashByPath(),
+			expectedKey: "/users/42",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			g.Expect(tc.key(r)).To(gomega.Equal(tc.expectedKey))
+		})
+	}
+}
+
+func TestConsistentHashSelect(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	nodes := newHashTestNodes(4)
+	ch := NewConsistentHash(HashByHeader("X-User"), 0)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-User", "alice")
+
+	// the same key always lands on the same node
+	first, err := ch.Select(nodes, r)
+	g.Expect(err).To(gomega.BeNil())
+	for i := 0; i < 10; i++ {
+		node, err := ch.Select(nodes, r)
+		g.Expect(err).To(gomega.BeNil())
+		g.Expect(node).To(gomega.Equal(first))
+	}
+
+	// the order of the nodes doesn't matter
+	reversed := []*Node{nodes[3], nodes[2], nodes[1], nodes[0]}
+	node, err := NewConsistentHash(HashByHeader("X-User"), 0).Select(reversed, r)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(node).To(gomega.Equal(first))
+
+	// a node that is down is skipped by walking the ring
+	first.SetAlive(false)
+	fallback, err := ch.Select(nodes, r)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(fallback).NotTo(gomega.Equal(first))
+
+	// and the key goes back once the node is up again
+	first.SetAlive(true)
+	node, err = ch.Select(nodes, r)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(node).To(gomega.Equal(first))
+
+	for _, n := range nodes {
+		n.SetAlive(false)
+	}
+	node, err = ch.Select(nodes, r)
+	g.Expect(node).To(gomega.BeNil())
+	g.Expect(err).To(gomega.Equal(ErrNoAvailableNode))
+}
+
+func TestConsistentHashRemapping(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	nodes := newHashTestNodes(10)
+	ch := NewConsistentHash(HashByQuery("key"), 0)
+
+	keys := 10000
+	assign := func(nodes []*Node) map[int]*Node {
+		assigned := map[int]*Node{}
+		for i := 0; i < keys; i++ {
+			r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/?key=%d", i), nil)
+			node, err := ch.Select(nodes, r)
+			g.Expect(err).To(gomega.BeNil())
+			assigned[i] = node
+		}
+		return assigned
+	}
+
+	before := assign(nodes)
+
+	// adding an 11th node should only move roughly 1/11 of the keys, all of them to the new node
+	added := append(append([]*Node{}, nodes...), &Node{URL: &url.URL{Scheme: "http", Host: "10.0.0.10:8080"}, alive: true, weight: 1})
+	after := assign(added)
+
+	moved := 0
+	for i := 0; i < keys; i++ {
+		if before[i] != after[i] {
+			moved++
+			g.Expect(after[i]).To(gomega.Equal(added[10]))
+		}
+	}
+
+	g.Expect(moved).To(gomega.BeNumerically(">", 0))
+	g.Expect(moved).To(gomega.BeNumerically("<", 2*keys/11))
+}
+
+func TestConsistentHashBalance(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	// URLs differing only by their last character must still get an even share of the keys
+	nodes := []*Node{}
+	for i := 1; i <= 4; i++ {
+		nodes = append(nodes, &Node{URL: &url.URL{Scheme: "http", Host: fmt.Sprintf("localhost:808%d", i)}, alive: true, weight: 1})
+	}
+	ch := NewConsistentHash(HashByClientIP(), 0)
+
+	keys := 10000
+	assigned := map[*Node]int{}
+	for i := 0; i < keys; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = fmt.Sprintf("10.0.%d.%d:51234", i/256, i%256)
+		node, err := ch.Select(nodes, r)
+		g.Expect(err).To(gomega.BeNil())
+		assigned[node]++
+	}
+
+	for _, node := range nodes {
+		g.Expect(assigned[node]).To(gomega.BeNumerically("~", keys/4, keys/20), node.URL.String())
+	}
+}
@@ -0,0 +1,383 @@
+package lb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxHealthCheckBodySize is the maximum number of bytes of a health check response
+// body that are matched against the expected content.
+const maxHealthCheckBodySize = 64 * 1024
+
+// jitterRand is the source of the random delays added to health check intervals.
+var jitterRand = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// errNodeUnreachable is reported when no TCP connection can be established with a node.
+var errNodeUnreachable = errors.New("connection refused or timed out")
+
+// Health check types.
+const (
+	HealthCheckHTTP = "http"
+	HealthCheckTCP  = "tcp"
+)
+
+// Default health check settings.
+const (
+	defaultHealthCheckInterval      = 5 * time.Second
+	defaultHealthCheckTimeout       = 1 * time.Second
+	defaultHealthCheckSlowThreshold = 200 * time.Millisecond
+)
+
+// HealthCheckConfig configures the active health check of the nodes of a pool.
+// Zero values fall back to an HTTP GET on "/" every 5 seconds expecting a 2xx or 3xx status
+// within 1 second, a single failure marking a node down and a single success marking it up again.
+// The HTTP settings are ignored by TCP health checks, which only open a connection.
+// Every check is delayed by a random duration up to Jitter so that several load balancers
+// don't probe the nodes in lockstep, and nodes taking longer than SlowThreshold to answer
+// the response time check get their weight lowered.
+type HealthCheckConfig struct {
+	Type               string            `json:"type,omitempty"`
+	Interval           Duration          `json:"interval,omitempty"`
+	Jitter             Duration          `json:"jitter,omitempty"`
+	SlowThreshold      Duration          `json:"slow_threshold,omitempty"`
+	HealthyThreshold   int               `json:"healthy_threshold,omitempty"`
+	UnhealthyThreshold int               `json:"unhealthy_threshold,omitempty"`
+	Path               string            `json:"path,omitempty"`
+	Method             string            `json:"method,omitempty"`
+	ExpectedStatus     []StatusRange     `json:"expected_status,omitempty"`
+	BodyContains       string            `json:"body_contains,omitempty"`
+	BodyRegex          string            `json:"body_regex,omitempty"`
+	Headers            map[string]string `json:"headers,omitempty"`
+	Timeout            Duration          `json:"timeout,omitempty"`
+}
+
+// StatusRange is an inclusive range of HTTP status codes.
+// In JSON it is either a single code (200), a range ("200-299") or a class ("2xx").
+type StatusRange struct {
+	Min int
+	Max int
+}
+
+// Contains reports whether the status code is within the range.
+func (sr StatusRange) Contains(status int) bool {
+	return status >= sr.Min && status <= sr.Max
+}
+
+// UnmarshalJSON decodes a status range given as a code, a range or a class.
+func (sr *StatusRange) UnmarshalJSON(data []byte) error {
+	var code int
+	if err := json.Unmarshal(data, &code); err == nil {
+		*sr = StatusRange{Min: code, Max: code}
+		return nil
+	}
+
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("invalid status range %s", data)
+	}
+
+	statusRange, err := parseStatusRange(value)
+	if err != nil {
+		return err
+	}
+
+	*sr = statusRange
+
+	return nil
+}
+
+// parseStatusRange parses a status code ("200"), a range ("200-299") or a class ("2xx").
+func parseStatusRange(value string) (StatusRange, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+
+	if len(value) == 3 && strings.HasSuffix(value, "xx") {
+		class, err := strconv.Atoi(value[:1])
+		if err != nil {
+			return StatusRange{}, fmt.Errorf("invalid status range '%s'", value)
+		}
+		return StatusRange{Min: class * 100, Max: class*100 + 99}, nil
+	}
+
+	bounds := strings.SplitN(value, "-", 2)
+	min, err := strconv.Atoi(bounds[0])
+	if err != nil {
+		return StatusRange{}, fmt.Errorf("invalid status range '%s'", value)
+	}
+
+	max := min
+	if len(bounds) == 2 {
+		max, err = strconv.Atoi(bounds[1])
+		if err != nil || max < min {
+			return StatusRange{}, fmt.Errorf("invalid status range '%s'", value)
+		}
+	}
+
+	return StatusRange{Min: min, Max: max}, nil
+}
+
+// HealthCheck actively checks the health of a node over HTTP or TCP.
+// A node is marked down after failing unhealthyThreshold checks in a row and
+// up again after passing healthyThreshold checks in a row.
+type HealthCheck struct {
+	cfg                HealthCheckConfig
+	checkType          string
+	interval           time.Duration
+	jitter             time.Duration
+	timeout            time.Duration
+	slowThreshold      time.Duration
+	healthyThreshold   int
+	unhealthyThreshold int
+	path               string
+	method             string
+	expectedStatus     []StatusRange
+	bodyContains       string
+	bodyRegex          *regexp.Regexp
+	headers            map[string]string
+	client             *http.Client
+}
+
+// NewHealthCheck creates a new health check from the given configuration.
+// It returns an error if the type or the thresholds are invalid or the body regex can't be compiled.
+func NewHealthCheck(cfg HealthCheckConfig) (*HealthCheck, error) {
+	hc := &HealthCheck{
+		cfg:                cfg,
+		checkType:          cfg.Type,
+		interval:           time.Duration(cfg.Interval),
+		jitter:             time.Duration(cfg.Jitter),
+		timeout:            time.Duration(cfg.Timeout),
+		slowThreshold:      time.Duration(cfg.SlowThreshold),
+		healthyThreshold:   cfg.HealthyThreshold,
+		unhealthyThreshold: cfg.UnhealthyThreshold,
+		path:               cfg.Path,
+		method:             cfg.Method,
+		expectedStatus:     cfg.ExpectedStatus,
+		bodyContains:       cfg.BodyContains,
+		headers:            cfg.Headers,
+	}
+
+	if hc.checkType == "" {
+		hc.checkType = HealthCheckHTTP
+	}
+
+	if hc.checkType != HealthCheckHTTP && hc.checkType != HealthCheckTCP {
+		return nil, fmt.Errorf("unknown health check type '%s'", hc.checkType)
+	}
+
+	if hc.healthyThreshold < 0 || hc.unhealthyThreshold < 0 {
+		return nil, errors.New("health check thresholds can't be negative")
+	}
+
+	if hc.healthyThreshold == 0 {
+		hc.healthyThreshold = 1
+	}
+
+	if hc.unhealthyThreshold == 0 {
+		hc.unhealthyThreshold = 1
+	}
+
+	if hc.interval < 0 || hc.jitter < 0 || hc.timeout < 0 || hc.slowThreshold < 0 {
+		return nil, errors.New("health check durations can't be negative")
+	}
+
+	if hc.interval == 0 {
+		hc.interval = defaultHealthCheckInterval
+	}
+
+	if hc.timeout == 0 {
+		hc.timeout = defaultHealthCheckTimeout
+	}
+
+	if hc.slowThreshold == 0 {
+		hc.slowThreshold = defaultHealthCheckSlowThreshold
+	}
+
+	if hc.path == "" {
+		hc.path = "/"
+	}
+
+	if hc.method == "" {
+		hc.method = http.MethodGet
+	}
+
+	if len(hc.expectedStatus) == 0 {
+		hc.expectedStatus = []StatusRange{{Min: 200, Max: 399}}
+	}
+
+	if cfg.BodyRegex != "" {
+		bodyRegex, err := regexp.Compile(cfg.BodyRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid health check body regex: %w", err)
+		}
+		hc.bodyRegex = bodyRegex
+	}
+
+	hc.client = &http.Client{
+		Timeout: hc.timeout,
+		// the status of the health check endpoint itself is checked, redirects are not followed
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	return hc, nil
+}
+
+// newTCPHealthCheck returns the health check used when none is configured, which only
+// checks that the node accepts TCP connections.
+func newTCPHealthCheck() *HealthCheck {
+	hc, _ := NewHealthCheck(HealthCheckConfig{Type: HealthCheckTCP})
+	return hc
+}
+
+// Override returns a copy of the health check where the non-zero settings of override
+// replace the ones of hc, so a node can tune the health check of its pool.
+func (hc *HealthCheck) Override(override HealthCheckConfig) (*HealthCheck, error) {
+	cfg := hc.cfg
+
+	if override.Type != "" {
+		cfg.Type = override.Type
+	}
+	if override.Interval != 0 {
+		cfg.Interval = override.Interval
+	}
+	if override.Jitter != 0 {
+		cfg.Jitter = override.Jitter
+	}
+	if override.SlowThreshold != 0 {
+		cfg.SlowThreshold = override.SlowThreshold
+	}
+	if override.HealthyThreshold != 0 {
+		cfg.HealthyThreshold = override.HealthyThreshold
+	}
+	if override.UnhealthyThreshold != 0 {
+		cfg.UnhealthyThreshold = override.UnhealthyThreshold
+	}
+	if override.Path != "" {
+		cfg.Path = override.Path
+	}
+	if override.Method != "" {
+		cfg.Method = override.Method
+	}
+	if len(override.ExpectedStatus) > 0 {
+		cfg.ExpectedStatus = override.ExpectedStatus
+	}
+	if override.BodyContains != "" {
+		cfg.BodyContains = override.BodyContains
+	}
+	if override.BodyRegex != "" {
+		cfg.BodyRegex = override.BodyRegex
+	}
+	if override.Headers != nil {
+		cfg.Headers = override.Headers
+	}
+	if override.Timeout != 0 {
+		cfg.Timeout = override.Timeout
+	}
+
+	return NewHealthCheck(cfg)
+}
+
+// nextDelay returns how long to wait before the next check: the interval plus a random jitter.
+func (hc *HealthCheck) nextDelay() time.Duration {
+	if hc.jitter <= 0 {
+		return hc.interval
+	}
+
+	jitterRand.Lock()
+	defer jitterRand.Unlock()
+
+	return hc.interval + time.Duration(jitterRand.Int63n(int64(hc.jitter)))
+}
+
+// Check probes the node and returns an error describing why the check failed, or nil if it passed.
+func (hc *HealthCheck) Check(node *Node) error {
+	if hc.checkType == HealthCheckTCP {
+		if !node.dial(hc.timeout) {
+			return errNodeUnreachable
+		}
+		return nil
+	}
+
+	req, err := hc.newRequest(node)
+	if err != nil {
+		return err
+	}
+
+	res, err := hc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if !hc.isExpectedStatus(res.StatusCode) {
+		return fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+
+	if hc.bodyContains == "" && hc.bodyRegex == nil {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxHealthCheckBodySize))
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	if hc.bodyContains != "" && !strings.Contains(string(body), hc.bodyContains) {
+		return fmt.Errorf("response body does not contain '%s'", hc.bodyContains)
+	}
+
+	if hc.bodyRegex != nil && !hc.bodyRegex.Match(body) {
+		return fmt.Errorf("response body does not match '%s'", hc.bodyRegex)
+	}
+
+	return nil
+}
+
+// newRequest returns the request probing the node, sent to its scheme with the method,
+// path and headers of the health check.
+func (hc *HealthCheck) newRequest(node *Node) (*http.Request, error) {
+	scheme := node.URL.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	req, err := http.NewRequest(hc.method, scheme+"://"+node.URL.Host+hc.path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, value := range hc.headers {
+		if strings.EqualFold(name, "Host") {
+			req.Host = value
+			continue
+		}
+		req.Header.Set(name, value)
+	}
+
+	// don't reuse connections so every check proves the node still accepts new ones
+	req.Close = true
+
+	return req, nil
+}
+
+// isExpectedStatus reports whether the status code is within one of the expected ranges.
+func (hc *HealthCheck) isExpectedStatus(status int) bool {
+	for _, statusRange := range hc.expectedStatus {
+		if statusRange.Contains(status) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,266 @@
+package lb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/bsm/gomega"
+)
+
+func TestStatusRangeUnmarshalJSON(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	testCases := []struct {
+		name          string
+		data          string
+		expectedRange StatusRange
+		expectedErr   bool
+	}{
+		{
+			name:          "single status code",
+			data:          `200`,
+			expectedRange: StatusRange{Min: 200, Max: 200},
+		},
+		{
+			name:          "status code range",
+			data:          `"200-299"`,
+			expectedRange: StatusRange{Min: 200, Max: 299},
+		},
+		{
+			name:          "status code class",
+			data:          `"3xx"`,
+			expectedRange: StatusRange{Min: 300, Max: 399},
+		},
+		{
+			name:        "reversed range",
+			data:        `"299-200"`,
+			expectedErr: true,
+		},
+		{
+			name:        "not a status code",
+			data:        `"ok"`,
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var statusRange StatusRange
+			err := json.Unmarshal([]byte(tc.data), &statusRange)
+
+			if tc.expectedErr {
+				g.Expect(err).NotTo(gomega.BeNil())
+			} else {
+				g.Expect(err).To(gomega.BeNil())
+				g.Expect(statusRange).To(gomega.Equal(tc.expectedRange))
+			}
+		})
+	}
+}
+
+func TestNewHealthCheckInvalidConfig(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	testCases := []struct {
+		name string
+		cfg  HealthCheckConfig
+	}{
+		{
+			name: "invalid body regex",
+			cfg:  HealthCheckConfig{BodyRegex: "("},
+		},
+		{
+			name: "unknown type",
+			cfg:  HealthCheckConfig{Type: "udp"},
+		},
+		{
+			name: "negative threshold",
+			cfg:  HealthCheckConfig{UnhealthyThreshold: -1},
+		},
+		{
+			name: "negative interval",
+			cfg:  HealthCheckConfig{Interval: Duration(-time.Second)},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			hc, err := NewHealthCheck(tc.cfg)
+
+			g.Expect(hc).To(gomega.BeNil())
+			g.Expect(err).NotTo(gomega.BeNil())
+		})
+	}
+}
+
+func TestTCPHealthCheck(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	// the TCP check passes even though the node answers with 500s
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer testServer.Close()
+
+	serverUrl, _ := url.Parse(testServer.URL)
+
+	hc, err := NewHealthCheck(HealthCheckConfig{Type: HealthCheckTCP, Path: "/health"})
+	g.Expect(err).To(gomega.BeNil())
+
+	g.Expect(hc.Check(&Node{URL: serverUrl})).To(gomega.BeNil())
+	g.Expect(hc.Check(&Node{URL: &url.URL{Host: "example.com"}})).To(gomega.Equal(errNodeUnreachable))
+}
+
+func TestHealthCheck(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health":
+			if r.Header.Get("X-Health-Token") != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, `{"status": "ok", "version": 42}`)
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		case "/redirect":
+			http.Redirect(w, r, "/health", http.StatusFound)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer testServer.Close()
+
+	url, _ := url.Parse(testServer.URL)
+	node := &Node{URL: url}
+
+	headers := map[string]string{"X-Health-Token": "secret"}
+
+	testCases := []struct {
+		name        string
+		cfg         HealthCheckConfig
+		expectedErr error
+	}{
+		{
+			name:        "default check fails on a 500",
+			cfg:         HealthCheckConfig{},
+			expectedErr: errors.New("unexpected status code 500"),
+		},
+		{
+			name: "path with headers",
+			cfg:  HealthCheckConfig{Path: "/health", Headers: headers},
+		},
+		{
+			name:        "missing headers",
+			cfg:         HealthCheckConfig{Path: "/health"},
+			expectedErr: errors.New("unexpected status code 401"),
+		},
+		{
+			name: "expected status",
+			cfg:  HealthCheckConfig{Path: "/health", ExpectedStatus: []StatusRange{{Min: 401, Max: 401}}},
+		},
+		{
+			name:        "redirects are not followed",
+			cfg:         HealthCheckConfig{Path: "/redirect", Headers: headers, ExpectedStatus: []StatusRange{{Min: 200, Max: 299}}},
+			expectedErr: errors.New("unexpected status code 302"),
+		},
+		{
+			name: "body contains",
+			cfg:  HealthCheckConfig{Path: "/health", Headers: headers, BodyContains: `"status": "ok"`},
+		},
+		{
+			name:        "body does not contain",
+			cfg:         HealthCheckConfig{Path: "/health", Headers: headers, BodyContains: "degraded"},
+			expectedErr: errors.New("response body does not contain 'degraded'"),
+		},
+		{
+			name: "body matches regex",
+			cfg:  HealthCheckConfig{Path: "/health", Headers: headers, BodyRegex: `"version": \d+`},
+		},
+		{
+			name:        "body does not match regex",
+			cfg:         HealthCheckConfig{Path: "/health", Headers: headers, BodyRegex: `"status": "down"`},
+			expectedErr: errors.New(`response body does not match '"status": "down"'`),
+		},
+		{
+			name: "method",
+			cfg:  HealthCheckConfig{Method: http.MethodHead, Path: "/health", Headers: headers},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			hc, err := NewHealthCheck(tc.cfg)
+			g.Expect(err).To(gomega.BeNil())
+
+			err = hc.Check(node)
+			if tc.expectedErr != nil {
+				g.Expect(err).To(gomega.Equal(tc.expectedErr))
+			} else {
+				g.Expect(err).To(gomega.BeNil())
+			}
+		})
+	}
+
+	t.Run("timeout", func(t *testing.T) {
+		hc, err := NewHealthCheck(HealthCheckConfig{Path: "/slow", Timeout: Duration(50 * time.Millisecond)})
+		g.Expect(err).To(gomega.BeNil())
+		g.Expect(hc.Check(node)).NotTo(gomega.BeNil())
+	})
+}
+
+func TestHealthCheckOverride(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	hc, err := NewHealthCheck(HealthCheckConfig{
+		Path:             "/health",
+		Interval:         Duration(10 * time.Second),
+		Timeout:          Duration(2 * time.Second),
+		HealthyThreshold: 3,
+	})
+	g.Expect(err).To(gomega.BeNil())
+
+	overridden, err := hc.Override(HealthCheckConfig{Interval: Duration(time.Second), SlowThreshold: Duration(time.Second)})
+	g.Expect(err).To(gomega.BeNil())
+
+	g.Expect(overridden.interval).To(gomega.Equal(time.Second))
+	g.Expect(overridden.slowThreshold).To(gomega.Equal(time.Second))
+	g.Expect(overridden.path).To(gomega.Equal("/health"))
+	g.Expect(overridden.timeout).To(gomega.Equal(2 * time.Second))
+	g.Expect(overridden.healthyThreshold).To(gomega.Equal(3))
+
+	// the original health check is left untouched
+	g.Expect(hc.interval).To(gomega.Equal(10 * time.Second))
+	g.Expect(hc.slowThreshold).To(gomega.Equal(defaultHealthCheckSlowThreshold))
+
+	_, err = hc.Override(HealthCheckConfig{Type: "udp"})
+	g.Expect(err).NotTo(gomega.BeNil())
+}
+
+func TestHealthCheckNextDelay(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	hc, err := NewHealthCheck(HealthCheckConfig{})
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(hc.nextDelay()).To(gomega.Equal(defaultHealthCheckInterval))
+
+	hc, err = NewHealthCheck(HealthCheckConfig{Interval: Duration(time.Second), Jitter: Duration(500 * time.Millisecond)})
+	g.Expect(err).To(gomega.BeNil())
+
+	delays := map[time.Duration]bool{}
+	for i := 0; i < 100; i++ {
+		delay := hc.nextDelay()
+		g.Expect(delay).To(gomega.BeNumerically(">=", time.Second))
+		g.Expect(delay).To(gomega.BeNumerically("<", 1500*time.Millisecond))
+		delays[delay] = true
+	}
+
+	g.Expect(len(delays)).To(gomega.BeNumerically(">", 1))
+}
@@ -1,124 +1,451 @@
 package lb
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"sort"
 	"sync"
-	"sync/atomic"
 	"time"
 )
 
-// LB represents a load balancer with the necessary configuration
+// Errors returned when changing the nodes of a load balancer.
+var (
+	ErrNodeExists   = errors.New("node already exists")
+	ErrNodeNotFound = errors.New("node not found")
+)
+
+// LB represents a load balancer with the necessary configuration.
+// Nodes must not be modified directly once the load balancer is serving requests,
+// use AddNode and RemoveNode instead.
 type LB struct {
-	Nodes       []*Node
-	current     int64
-	mux         sync.Mutex
-	cookie      *http.Cookie
-	totalWeight float64
+	Nodes            []*Node
+	strategy         Strategy
+	healthCheck      *HealthCheck
+	outlierDetection *OutlierDetectionConfig
+	ejectionGuard    *ejectionGuard
+	retry            *RetryConfig
+	circuitBreaker   *CircuitBreakerConfig
+	slowStart        *SlowStartConfig
+	drain            *DrainConfig
+	affinity         *AffinityConfig
+	signer           *cookieSigner
+	nodeIDs          map[string]*Node
+	table            *affinityTable
+	pendingRemoval   map[*Node]struct{}
+	done             chan struct{}
+	stopOnce         sync.Once
+	wg               sync.WaitGroup
+	mux              sync.RWMutex
+	totalWeight      float64
+}
+
+// New creates a load balancer proxying requests to the given servers, configured by opts.
+// The load balancer is an http.Handler to be served by the caller. Its background work,
+// such as the health check of the nodes, starts right away and runs until ctx is
+// cancelled or Close is called.
+func New(ctx context.Context, servers []ServerConfig, opts ...Option) (*LB, error) {
+	lb, err := newServerNodes(servers)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, opt := range opts {
+		opt(lb)
+	}
+
+	if err := lb.setupNodes(); err != nil {
+		return nil, err
+	}
+
+	done := lb.stopped()
+	lb.wg.Add(2)
+	go func() {
+		defer lb.wg.Done()
+		lb.RunHealthCheck()
+	}()
+	go func() {
+		defer lb.wg.Done()
+		select {
+		case <-ctx.Done():
+			lb.Stop()
+		case <-done:
+		}
+	}()
+
+	return lb, nil
 }
 
 // NewLoadBalancer creates a new load balancer with the given list of origin servers.
 // It returns a new http.Server instance for the load balancer to listen on incoming requests.
-func NewLoadBalancer(originServerList []string, port int) (*http.Server, error) {
-	serverPool, err := newServerNodes(originServerList)
+// Optional behaviour such as the balancing strategy can be set through opts.
+func NewLoadBalancer(originServerList []string, port int, opts ...Option) (*http.Server, error) {
+	return NewLoadBalancerWithServers(serverConfigs(originServerList), port, opts...)
+}
+
+// NewLoadBalancerWithServers creates a new load balancer like NewLoadBalancer, using the
+// weight of each server as the base weight of its node.
+// Shutting the server down stops the load balancer.
+func NewLoadBalancerWithServers(servers []ServerConfig, port int, opts ...Option) (*http.Server, error) {
+	serverPool, err := New(context.Background(), servers, opts...)
 	if err != nil {
 		return nil, err
 	}
 
-	go serverPool.RunHealthCheck()
-
-	return &http.Server{
+	srv := &http.Server{
 		Addr:    fmt.Sprintf(":%d", port),
 		Handler: serverPool,
-	}, nil
-}
+	}
+	srv.RegisterOnShutdown(serverPool.Stop)
 
-// NextIndex returns the index of the next node in the slice
-func (lb *LB) NextIndex() int64 {
-	return atomic.AddInt64(&lb.current, int64(1)) % int64(len(lb.Nodes))
+	return srv, nil
 }
 
 // ServeHTTP handles the HTTP request and sends the response back through the provided http.ResponseWriter.
-// It selects a node based on the load balancing strategy
+// It selects a node based on the load balancing strategy. No lock is held while the request is
+// proxied, so a slow node only delays its own clients.
 func (lb *LB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	lb.mux.Lock()
-	defer lb.mux.Unlock()
-
 	node, err := lb.selectServer(w, r)
 	if err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
-	node.ReverseProxy.ServeHTTP(w, r)
+
+	if lb.retry != nil && lb.retry.MaxAttempts > 1 && lb.retry.allowsMethod(r.Method) {
+		lb.serveWithRetry(w, r, node, lb.retry)
+		return
+	}
+
+	lb.proxy(w, r, node)
+}
+
+// proxy proxies the request to node, or to another node picked by the strategy when node
+// started draining since it was selected.
+func (lb *LB) proxy(w http.ResponseWriter, r *http.Request, node *Node) {
+	tried := map[*Node]bool{}
+	for errors.Is(node.proxy(w, r), errNodeDraining) {
+		tried[node] = true
+		next, err := lb.selectRetryNode(r, tried)
+		if err != nil {
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		lb.repin(w, r, next)
+		node = next
+	}
 }
 
-// RunHealthCheck passively checks the health status of all the nodes
+// RunHealthCheck periodically checks the health status of all the nodes until the load
+// balancer is stopped. Every node is checked right away and then at the interval of its
+// health check plus a random jitter.
 func (lb *LB) RunHealthCheck() {
 	log.Default().Println("Running health check...")
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		lb.sortNodesByWeight()
-		for _, n := range lb.Nodes {
-			status := n.CheckNode()
-			n.SetAlive(status)
-			statusString := "down"
-			if status {
-				statusString = "up"
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	done := lb.stopped()
+	for {
+		select {
+		case <-done:
+			log.Default().Println("Health check stopped")
+			return
+		case <-timer.C:
+			timer.Reset(lb.checkDueNodes())
+		}
+	}
+}
+
+// Stop stops the background work of the load balancer, such as RunHealthCheck.
+// It doesn't interrupt the requests being proxied, shut the http.Server down for that.
+// The load balancer keeps serving requests with the last known state of the nodes.
+func (lb *LB) Stop() {
+	done := lb.stopped()
+	lb.stopOnce.Do(func() {
+		close(done)
+	})
+}
+
+// Close stops the background work of the load balancer like Stop, and waits for it to
+// be over. Requests being proxied are not interrupted.
+func (lb *LB) Close() error {
+	lb.Stop()
+	lb.wg.Wait()
+	return nil
+}
+
+// stopped returns a channel closed once the load balancer is stopped.
+func (lb *LB) stopped() chan struct{} {
+	lb.mux.Lock()
+	defer lb.mux.Unlock()
+
+	return lb.stoppedLocked()
+}
+
+// stoppedLocked is stopped for callers holding the lock.
+func (lb *LB) stoppedLocked() chan struct{} {
+	if lb.done == nil {
+		lb.done = make(chan struct{})
+	}
+	return lb.done
+}
+
+// checkDueNodes concurrently checks the nodes whose next check is due and returns
+// how long to wait until the next check of any node is due.
+func (lb *LB) checkDueNodes() time.Duration {
+	now := time.Now()
+	wait := lb.poolHealthCheck().interval
+
+	var wg sync.WaitGroup
+	for _, n := range lb.nodes() {
+		if n.nextCheck.After(now) {
+			if until := n.nextCheck.Sub(now); until < wait {
+				wait = until
 			}
+			continue
+		}
+
+		delay := lb.nodeHealthCheck(n).nextDelay()
+		n.nextCheck = now.Add(delay)
+		if delay < wait {
+			wait = delay
+		}
+
+		wg.Add(1)
+		go func(n *Node) {
+			defer wg.Done()
+			lb.healthCheckNode(n)
+		}(n)
+	}
+	wg.Wait()
+
+	// the time spent checking counts towards the wait
+	wait -= time.Since(now)
+	if wait < 0 {
+		wait = 0
+	}
+
+	return wait
+}
+
+// healthCheckNode checks the node, updates its status and logs the result.
+func (lb *LB) healthCheckNode(n *Node) {
+	err := lb.checkHealth(n)
+	n.recordCheck(err == nil)
+	statusString := "down"
+	if n.IsAlive() {
+		statusString = "up"
+	}
+
+	logString := fmt.Sprintf("Node '%s' status: %s", n.URL.Host, statusString)
+	if err != nil {
+		logString = logString + fmt.Sprintf(", check failed: %s", err)
+	}
+
+	if err == nil {
+		n.CheckResponseTime()
+
+		unhealthyString := "healthy"
+		if n.IsUnhealthy() {
+			unhealthyString = "unhealthy"
+		}
+
+		logString = logString + fmt.Sprintf(", Healthy status: %s", unhealthyString)
+	}
+
+	log.Default().Println(logString)
+}
+
+// poolHealthCheck returns the health check of the load balancer, falling back
+// to only checking that the nodes accept TCP connections.
+func (lb *LB) poolHealthCheck() *HealthCheck {
+	if lb.healthCheck != nil {
+		return lb.healthCheck
+	}
+
+	return newTCPHealthCheck()
+}
 
-			logString := fmt.Sprintf("Node '%s' status: %s", n.URL.Host, statusString)
+// nodeHealthCheck returns the health check of the node, falling back to the one of the load balancer.
+func (lb *LB) nodeHealthCheck(n *Node) *HealthCheck {
+	if n.healthCheck != nil {
+		return n.healthCheck
+	}
 
-			if statusString == "up" {
-				n.CheckResponseTime()
+	return lb.poolHealthCheck()
+}
 
-				unhealthyString := "healthy"
-				if n.unhealthy {
-					unhealthyString = "unhealthy"
-				}
+// checkHealth runs the health check of the node. It returns why the check failed, or nil if it passed.
+func (lb *LB) checkHealth(n *Node) error {
+	return lb.nodeHealthCheck(n).Check(n)
+}
 
-				logString = logString + fmt.Sprintf(", Healthy status: %s", unhealthyString)
+// checkNewNodes runs a first health check of nodes about to be added while the load
+// balancer is running, marking the failing ones down so they don't take traffic until
+// the periodic health check brings them up.
+func (lb *LB) checkNewNodes(nodes []*Node) {
+	var wg sync.WaitGroup
+	for _, n := range nodes {
+		wg.Add(1)
+		go func(n *Node) {
+			defer wg.Done()
+			if err := lb.checkHealth(n); err != nil {
+				n.SetAlive(false)
+				log.Default().Printf("Node '%s' added down, check failed: %s", n.URL.Host, err)
 			}
+		}(n)
+	}
+	wg.Wait()
+}
+
+// setupNodes validates the retry, drain and affinity settings and applies the health check, outlier detection,
+// circuit breaker and slow start settings of the load balancer to every node.
+func (lb *LB) setupNodes() error {
+	if lb.outlierDetection != nil {
+		if err := lb.outlierDetection.validate(); err != nil {
+			return err
+		}
+		lb.ejectionGuard = &ejectionGuard{maxPercent: lb.outlierDetection.MaxEjectionPercent, nodes: lb.nodes}
+	}
+
+	if lb.retry != nil {
+		if err := lb.retry.validate(); err != nil {
+			return err
+		}
+	}
+
+	if lb.circuitBreaker != nil {
+		if err := lb.circuitBreaker.validate(); err != nil {
+			return err
+		}
+	}
+
+	if lb.slowStart != nil {
+		if err := lb.slowStart.validate(); err != nil {
+			return err
+		}
+	}
 
-			log.Default().Println(logString)
+	if lb.drain != nil {
+		if err := lb.drain.validate(); err != nil {
+			return err
 		}
 	}
+
+	if err := lb.setupAffinity(); err != nil {
+		return err
+	}
+
+	for _, n := range lb.Nodes {
+		if err := lb.setupNode(n); err != nil {
+			return err
+		}
+	}
+
+	lb.mux.Lock()
+	lb.indexNodeIDsLocked()
+	lb.mux.Unlock()
+
+	return nil
+}
+
+// setupNode applies the health check of the load balancer to the node, with the settings
+// the node overrides, and gives it an outlier detector, a circuit breaker and a slow start
+// when they are enabled, and its IDs in the session cookies.
+func (lb *LB) setupNode(n *Node) error {
+	hc := lb.poolHealthCheck()
+	if n.hcOverride != nil {
+		nodeHealthCheck, err := hc.Override(*n.hcOverride)
+		if err != nil {
+			return fmt.Errorf("invalid health check for node '%s': %w", n.URL, err)
+		}
+		hc = nodeHealthCheck
+	}
+	n.healthCheck = hc
+
+	n.outlier = nil
+	if lb.outlierDetection != nil {
+		n.outlier = newOutlierDetector(*lb.outlierDetection, n.URL.Host)
+		n.outlier.guard = lb.ejectionGuard
+	}
+
+	n.breaker = nil
+	if lb.circuitBreaker != nil {
+		n.breaker = newCircuitBreaker(*lb.circuitBreaker, n.URL.Host)
+	}
+
+	cookieIDs := lb.cookieSigner().nodeIDs(n.URL)
+
+	n.mux.Lock()
+	n.slowStart = lb.slowStart
+	n.keepSessions = lb.drain != nil && lb.drain.KeepSessions
+	n.cookieIDs = cookieIDs
+	n.mux.Unlock()
+
+	return nil
 }
 
-// selectServer selects a node based on the load balancing strategy
+// selectServer selects a node based on the load balancing strategy and the session affinity
 func (lb *LB) selectServer(w http.ResponseWriter, r *http.Request) (*Node, error) {
-	cookie, err := r.Cookie("session")
+	if lb.affinityConfig().Mode == AffinityNone {
+		return lb.getNextHealthyNode(r)
+	}
+
+	if lb.table != nil {
+		return lb.selectServerByTable(r)
+	}
+
+	cookie, err := r.Cookie(lb.affinityConfig().Cookie.Name)
 	if err == nil {
-		return lb.selectServerByCookie(w, cookie)
+		return lb.selectServerByCookie(w, r, cookie)
 	}
 
-	return lb.selectServerByNextHealthyNode(w)
+	return lb.selectServerByNextHealthyNode(w, r)
 }
 
-// selectServerByCookie selects a node by session cookie
-func (lb *LB) selectServerByCookie(w http.ResponseWriter, cookie *http.Cookie) (*Node, error) {
-	for _, node := range lb.Nodes {
-		if node.URL.String() == cookie.Value {
-			if !node.CheckNode() {
-				return lb.selectServerByNextHealthyNode(w)
-			}
+// selectServerByCookie selects a node by session cookie.
+// Cookies whose signature is invalid or whose session expired are ignored. When the node of
+// the session can't serve it, the session fails over to the node picked by its ID.
+func (lb *LB) selectServerByCookie(w http.ResponseWriter, r *http.Request, cookie *http.Cookie) (*Node, error) {
+	now := time.Now()
+	s, ok := lb.readSession(cookie.Value, now)
+	if !ok {
+		return lb.selectServerByNextHealthyNode(w, r)
+	}
+
+	pinned := lb.nodeByID(s.nodeID)
+	node := pinned
+	if pinned == nil || !lb.acceptsSession(pinned) {
+		var err error
+		if node, err = lb.failoverNode(s.id); err != nil {
+			return nil, err
+		}
 
+		// the session moves to the new node, unless it goes back to its node once it
+		// recovers, which removed nodes never do
+		if pinned == nil || !lb.affinityConfig().Failback {
+			s.nodeID = lb.cookieSigner().nodeID(node.URL)
+			s.seen = now
+			lb.writeSession(w, s)
 			return node, nil
 		}
 	}
 
-	return lb.selectServerByNextHealthyNode(w)
+	// keep the session alive
+	if lb.affinityConfig().IdleTTL > 0 {
+		s.seen = now
+		lb.writeSession(w, s)
+	}
+
+	return node, nil
 }
 
 // selectServerByNextHealthyNode selects the next healthy node
-func (lb *LB) selectServerByNextHealthyNode(w http.ResponseWriter) (*Node, error) {
-	node, err := lb.getNextHealthyNode()
+func (lb *LB) selectServerByNextHealthyNode(w http.ResponseWriter, r *http.Request) (*Node, error) {
+	node, err := lb.getNextHealthyNode(r)
 
 	if err != nil {
 		return nil, err
@@ -129,71 +456,182 @@ func (lb *LB) selectServerByNextHealthyNode(w http.ResponseWriter) (*Node, error
 	return node, nil
 }
 
-// getNextHealthyNode returns the next available healthy node and actively update the
-// status of the choose node
-func (lb *LB) getNextHealthyNode() (*Node, error) {
-	// sort the nodes by its weight in descending order
-	lb.sortNodesByWeight()
+// getNextHealthyNode returns the next available healthy node picked by the load balancing strategy
+func (lb *LB) getNextHealthyNode(r *http.Request) (*Node, error) {
+	return lb.balancingStrategy().Select(lb.nodes(), r)
+}
 
-	for i := 0; i < len(lb.Nodes); i++ {
-		node := lb.Nodes[lb.current]
-		lb.current = lb.NextIndex()
-		if node.CheckNode() {
-			return node, nil
-		} else {
-			node.SetAlive(false)
-		}
+// balancingStrategy returns the strategy of the load balancer, falling back to smooth
+// weighted round robin when none was set, such as with WithStrategy(nil).
+func (lb *LB) balancingStrategy() Strategy {
+	lb.mux.RLock()
+	strategy := lb.strategy
+	lb.mux.RUnlock()
+	if strategy != nil {
+		return strategy
 	}
 
-	return nil, errors.New("no available node")
-}
+	lb.mux.Lock()
+	defer lb.mux.Unlock()
 
-// setCookie sets a session cookie with the provided node URL string as value in the HTTP response writer w.
-// It also sets lb.cookie to the same cookie for future reference.
-func (lb *LB) setCookie(w http.ResponseWriter, node *Node) {
-	lb.cookie = &http.Cookie{
-		Name:  "session",
-		Value: node.URL.String(),
-		Path:  "/",
+	if lb.strategy == nil {
+		lb.strategy = NewWeightedRoundRobin()
 	}
+	return lb.strategy
+}
 
-	http.SetCookie(w, lb.cookie)
+// setCookie starts a new session pinned to the node, setting its cookie in the HTTP response writer w.
+func (lb *LB) setCookie(w http.ResponseWriter, node *Node) {
+	now := time.Now()
+	lb.writeSession(w, session{id: newSessionID(), nodeID: lb.cookieSigner().nodeID(node.URL), created: now, seen: now})
 }
 
 // newServerNodes returns a new Load Balancer (LB) struct that contains a list of Nodes,
-// where each Node represents an upstream server specified in the originServerList argument.
-// For each URL in originServerList, a new Node is created and appended to the nodes slice.
-// The function returns an error if any URL in originServerList is invalid.
-func newServerNodes(originServerList []string) (*LB, error) {
+// where each Node represents an upstream server specified in the servers argument.
+// For each server, a new Node is created with the configured weight and appended to the nodes slice.
+// The function returns an error if the URL of any server is invalid.
+func newServerNodes(servers []ServerConfig) (*LB, error) {
 	nodes := []*Node{}
 	var totalWeight float64
-	for _, urlString := range originServerList {
-		url, err := url.Parse(urlString)
+	for _, server := range servers {
+		n, err := newNode(server)
 		if err != nil {
 			return nil, err
 		}
 
-		proxy := httputil.NewSingleHostReverseProxy(url)
-
-		n := &Node{
-			URL:          url,
-			ReverseProxy: proxy,
-			weight:       1, //set default weight to 1
-		}
-
 		nodes = append(nodes, n)
 		totalWeight += n.weight
 	}
 
-	return &LB{
+	lb := &LB{
 		Nodes:       nodes,
-		mux:         sync.Mutex{},
+		healthCheck: newTCPHealthCheck(),
+		strategy:    NewWeightedRoundRobin(),
+		retry:       &RetryConfig{},
+		mux:         sync.RWMutex{},
 		totalWeight: totalWeight,
-	}, nil
+	}
+
+	if err := lb.setupNodes(); err != nil {
+		return nil, err
+	}
+
+	return lb, nil
+}
+
+// Node returns the node proxying requests to the given URL, or nil if there is none.
+func (lb *LB) Node(rawURL string) *Node {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil
+	}
+
+	lb.mux.RLock()
+	defer lb.mux.RUnlock()
+
+	for _, n := range lb.Nodes {
+		if n.URL.String() == u.String() {
+			return n
+		}
+	}
+
+	return nil
+}
+
+// AddNode adds a node proxying requests to the server, set up with the settings of the
+// load balancer. It returns ErrNodeExists if a node already proxies requests to its URL.
+// The node is health checked once before taking traffic, and starts down if the check
+// fails, then is checked from the next iteration of RunHealthCheck.
+func (lb *LB) AddNode(server ServerConfig) (*Node, error) {
+	n, err := newNode(server)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lb.setupNode(n); err != nil {
+		return nil, err
+	}
+
+	if lb.Node(n.URL.String()) != nil {
+		return nil, ErrNodeExists
+	}
+
+	lb.checkNewNodes([]*Node{n})
+
+	lb.mux.Lock()
+	defer lb.mux.Unlock()
+
+	for _, node := range lb.Nodes {
+		if node.URL.String() == n.URL.String() {
+			return nil, ErrNodeExists
+		}
+	}
+
+	// copy on write, so snapshots being iterated are never modified
+	nodes := make([]*Node, 0, len(lb.Nodes)+1)
+	nodes = append(nodes, lb.Nodes...)
+	lb.Nodes = append(nodes, n)
+	lb.indexNodeIDsLocked()
+
+	return n, nil
+}
+
+// RemoveNode removes the node proxying requests to the given URL. It returns ErrNodeNotFound
+// if there is none. Requests already proxied to the node are not interrupted.
+func (lb *LB) RemoveNode(rawURL string) (*Node, error) {
+	n := lb.Node(rawURL)
+	if n == nil {
+		return nil, ErrNodeNotFound
+	}
+
+	lb.mux.Lock()
+	defer lb.mux.Unlock()
+
+	if !lb.removeNodeLocked(n) {
+		return nil, ErrNodeNotFound
+	}
+	delete(lb.pendingRemoval, n)
+
+	return n, nil
+}
+
+// removeNodeLocked removes the node from the load balancer, and returns false if it
+// wasn't part of it. The lock must be held.
+func (lb *LB) removeNodeLocked(n *Node) bool {
+	nodes := make([]*Node, 0, len(lb.Nodes))
+	for _, node := range lb.Nodes {
+		if node != n {
+			nodes = append(nodes, node)
+		}
+	}
+
+	if len(nodes) == len(lb.Nodes) {
+		return false
+	}
+	lb.Nodes = nodes
+	lb.indexNodeIDsLocked()
+
+	return true
+}
+
+// nodes returns a snapshot of lb.Nodes sorted by weight in descending order.
+// The lock is only held while copying the slice, so the caller can iterate the
+// snapshot freely while other requests are being served.
+func (lb *LB) nodes() []*Node {
+	lb.mux.RLock()
+	nodes := make([]*Node, len(lb.Nodes))
+	copy(nodes, lb.Nodes)
+	lb.mux.RUnlock()
+
+	sortNodesByWeight(nodes)
+
+	return nodes
 }
 
-func (lb *LB) sortNodesByWeight() {
-	sort.Slice(lb.Nodes, func(i, j int) bool {
-		return lb.Nodes[i].weight > lb.Nodes[j].weight
+// sortNodesByWeight sorts the given nodes by their weight in descending order.
+// Nodes with the same weight keep their relative order.
+func sortNodesByWeight(nodes []*Node) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return nodes[i].Weight() > nodes[j].Weight()
 	})
 }
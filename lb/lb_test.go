@@ -1,34 +1,20 @@
 package lb
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/bsm/gomega"
 )
 
-func TestNextIndex(t *testing.T) {
-	g := gomega.NewGomegaWithT(t)
-
-	node1 := &Node{}
-	node2 := &Node{}
-	node3 := &Node{}
-	lb := &LB{Nodes: []*Node{node1, node2, node3}}
-
-	g.Expect(lb.current).To(gomega.Equal(int64(0)))
-	g.Expect(lb.NextIndex()).To(gomega.Equal(int64(1)))
-	g.Expect(lb.NextIndex()).To(gomega.Equal(int64(2)))
-	g.Expect(lb.NextIndex()).To(gomega.Equal(int64(0)))
-	g.Expect(lb.NextIndex()).To(gomega.Equal(int64(1)))
-	g.Expect(lb.NextIndex()).To(gomega.Equal(int64(2)))
-}
-
 func TestRunHealthCheck(t *testing.T) {
 	g := gomega.NewGomegaWithT(t)
 
@@ -41,27 +27,289 @@ func TestRunHealthCheck(t *testing.T) {
 		w.WriteHeader(http.StatusOK)
 	}))
 
-	node1 := &Node{URL: &url.URL{Host: strings.TrimPrefix(mockServer1.URL, "http://")}, alive: true}
-	node2 := &Node{URL: &url.URL{Host: strings.TrimPrefix(mockServer2.URL, "http://")}, alive: true}
+	node1 := &Node{URL: &url.URL{Host: strings.TrimPrefix(mockServer1.URL, "http://")}, alive: false}
+	node2 := &Node{URL: &url.URL{Host: strings.TrimPrefix(mockServer2.URL, "http://")}, alive: false}
+
+	hc, err := NewHealthCheck(HealthCheckConfig{Type: HealthCheckTCP, Interval: Duration(10 * time.Millisecond), Jitter: Duration(5 * time.Millisecond)})
+	g.Expect(err).To(gomega.BeNil())
 
-	lb := &LB{Nodes: []*Node{node1, node2}}
+	lb := &LB{Nodes: []*Node{node1, node2}, healthCheck: hc}
 
 	// Run health check
 	go lb.RunHealthCheck()
-	time.Sleep(10 * time.Second)
 
-	g.Expect(node1.IsAlive()).To(gomega.BeTrue())
-	g.Expect(node2.IsAlive()).To(gomega.BeTrue())
+	g.Eventually(node1.IsAlive, time.Second).Should(gomega.BeTrue())
+	g.Eventually(node2.IsAlive, time.Second).Should(gomega.BeTrue())
 
 	// set node2 to be down
 	mockServer2.Close()
 
-	// Re-Run health check
+	g.Eventually(node2.IsAlive, time.Second).Should(gomega.BeFalse())
+	g.Consistently(node1.IsAlive, 100*time.Millisecond).Should(gomega.BeTrue())
+}
+
+func TestStop(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	lb, err := newServerNodes(serverConfigs([]string{"http://localhost:8081"}))
+	g.Expect(err).To(gomega.BeNil())
+
+	stopped := make(chan struct{})
+	go func() {
+		lb.RunHealthCheck()
+		close(stopped)
+	}()
+
+	lb.Stop()
+	g.Eventually(stopped).Should(gomega.BeClosed())
+
+	// stopping twice is fine
+	lb.Stop()
+}
+
+func TestNew(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer testServer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	lb, err := New(ctx, serverConfigs([]string{testServer.URL}), WithStrategy(NewRoundRobin()))
+	g.Expect(err).To(gomega.BeNil())
+
+	// the load balancer is a handler of its own
+	mux := http.NewServeMux()
+	mux.Handle("/app/", lb)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/app/", nil))
+	g.Expect(w.Code).To(gomega.Equal(http.StatusOK))
+	g.Expect(w.Body.String()).To(gomega.Equal("ok"))
+
+	// cancelling the context stops the background work
+	cancel()
+	g.Eventually(lb.stopped()).Should(gomega.BeClosed())
+	g.Expect(lb.Close()).To(gomega.Succeed())
+
+	_, err = New(context.Background(), serverConfigs([]string{testServer.URL}), WithRetry(RetryConfig{MaxAttempts: -1}))
+	g.Expect(err).NotTo(gomega.BeNil())
+}
+
+func TestClose(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	lb, err := New(context.Background(), serverConfigs([]string{"http://localhost:8081"}))
+	g.Expect(err).To(gomega.BeNil())
+
+	g.Expect(lb.Close()).To(gomega.Succeed())
+	g.Expect(lb.stopped()).To(gomega.BeClosed())
+
+	// closing twice is fine
+	g.Expect(lb.Close()).To(gomega.Succeed())
+}
+
+func TestShutdownStopsLB(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	srv, err := NewLoadBalancer([]string{"http://localhost:8081"}, 0)
+	g.Expect(err).To(gomega.BeNil())
+
+	g.Expect(srv.Shutdown(context.Background())).To(gomega.Succeed())
+	g.Eventually(srv.Handler.(*LB).stopped()).Should(gomega.BeClosed())
+}
+
+func TestRunHealthCheckNodeOverride(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	var fastChecks, slowChecks int64
+	fastServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			atomic.AddInt64(&fastChecks, 1)
+		}
+	}))
+	defer fastServer.Close()
+
+	slowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			atomic.AddInt64(&slowChecks, 1)
+		}
+	}))
+	defer slowServer.Close()
+
+	lb, err := newServerNodes([]ServerConfig{
+		{URL: fastServer.URL},
+		{URL: slowServer.URL, HealthCheck: &HealthCheckConfig{Interval: Duration(time.Hour)}},
+	})
+	g.Expect(err).To(gomega.BeNil())
+
+	hc, err := NewHealthCheck(HealthCheckConfig{Path: "/health", Interval: Duration(10 * time.Millisecond)})
+	g.Expect(err).To(gomega.BeNil())
+
+	WithHealthCheck(hc)(lb)
+	g.Expect(lb.setupNodes()).To(gomega.BeNil())
+
+	// the overriding node keeps the settings of the pool it doesn't override
+	g.Expect(lb.Nodes[1].healthCheck.path).To(gomega.Equal("/health"))
+	g.Expect(lb.Nodes[1].healthCheck.interval).To(gomega.Equal(time.Hour))
+
 	go lb.RunHealthCheck()
-	time.Sleep(10 * time.Second)
 
-	g.Expect(node1.IsAlive()).To(gomega.BeTrue())
-	g.Expect(node2.IsAlive()).To(gomega.BeFalse())
+	g.Eventually(func() int64 { return atomic.LoadInt64(&fastChecks) }, time.Second).Should(gomega.BeNumerically(">=", 5))
+	// a single check, followed by the response time probe using the same path
+	g.Expect(atomic.LoadInt64(&slowChecks)).To(gomega.Equal(int64(2)))
+}
+
+func TestSetupNodesOutlierDetection(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	lb, err := newServerNodes(serverConfigs([]string{"http://localhost:8081", "http://localhost:8082"}))
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(lb.Nodes[0].outlier).To(gomega.BeNil())
+
+	WithOutlierDetection(OutlierDetectionConfig{MaxFailures: 2})(lb)
+	g.Expect(lb.setupNodes()).To(gomega.BeNil())
+
+	// every node gets its own detector
+	g.Expect(lb.Nodes[0].outlier).NotTo(gomega.BeNil())
+	g.Expect(lb.Nodes[1].outlier).NotTo(gomega.BeNil())
+	g.Expect(lb.Nodes[0].outlier).NotTo(gomega.BeIdenticalTo(lb.Nodes[1].outlier))
+	g.Expect(lb.Nodes[0].outlier.cfg.MaxFailures).To(gomega.Equal(2))
+
+	WithOutlierDetection(OutlierDetectionConfig{FailureRatio: -1})(lb)
+	g.Expect(lb.setupNodes()).NotTo(gomega.BeNil())
+}
+
+func TestSetupNodesCircuitBreaker(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	lb, err := newServerNodes(serverConfigs([]string{"http://localhost:8081", "http://localhost:8082"}))
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(lb.Nodes[0].breaker).To(gomega.BeNil())
+	g.Expect(lb.Nodes[0].CircuitState()).To(gomega.Equal(CircuitClosed))
+
+	WithCircuitBreaker(CircuitBreakerConfig{FailureThreshold: 2})(lb)
+	g.Expect(lb.setupNodes()).To(gomega.BeNil())
+
+	// every node gets its own circuit breaker
+	g.Expect(lb.Nodes[0].breaker).NotTo(gomega.BeNil())
+	g.Expect(lb.Nodes[0].breaker).NotTo(gomega.BeIdenticalTo(lb.Nodes[1].breaker))
+	g.Expect(lb.Nodes[0].breaker.cfg.FailureThreshold).To(gomega.Equal(2))
+
+	WithCircuitBreaker(CircuitBreakerConfig{HalfOpenRequests: -1})(lb)
+	g.Expect(lb.setupNodes()).NotTo(gomega.BeNil())
+}
+
+func TestAddRemoveNode(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	lb, err := newServerNodes(serverConfigs([]string{"http://localhost:8081"}))
+	g.Expect(err).To(gomega.BeNil())
+	WithOutlierDetection(OutlierDetectionConfig{})(lb)
+	g.Expect(lb.setupNodes()).To(gomega.BeNil())
+
+	// added nodes are set up like the others
+	n, err := lb.AddNode(ServerConfig{URL: "http://localhost:8082", Weight: 2})
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(n.outlier).NotTo(gomega.BeNil())
+	g.Expect(n.healthCheck).NotTo(gomega.BeNil())
+	g.Expect(lb.Node("http://localhost:8082")).To(gomega.BeIdenticalTo(n))
+
+	_, err = lb.AddNode(ServerConfig{URL: "http://localhost:8082"})
+	g.Expect(err).To(gomega.Equal(ErrNodeExists))
+
+	removed, err := lb.RemoveNode("http://localhost:8081")
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(removed.URL.String()).To(gomega.Equal("http://localhost:8081"))
+	g.Expect(lb.nodes()).To(gomega.Equal([]*Node{n}))
+
+	_, err = lb.RemoveNode("http://localhost:8081")
+	g.Expect(err).To(gomega.Equal(ErrNodeNotFound))
+}
+
+func TestAddNodeChecksNode(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer testServer.Close()
+
+	lb, err := newServerNodes(serverConfigs([]string{testServer.URL}))
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(lb.setupNodes()).To(gomega.BeNil())
+
+	// a node that doesn't pass its first check starts down and takes no traffic
+	dead, err := lb.AddNode(ServerConfig{URL: "http://127.0.0.1:9", Weight: 1})
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(dead.IsAlive()).To(gomega.BeFalse())
+
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", nil))
+		g.Expect(w.Code).To(gomega.Equal(http.StatusOK))
+	}
+
+	lb.RemoveNode(testServer.URL)
+	live, err := lb.AddNode(ServerConfig{URL: testServer.URL, Weight: 1})
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(live.IsAlive()).To(gomega.BeTrue())
+
+	for _, url := range []string{"localhost:9", "ftp://localhost:9", "http://", "/path"} {
+		_, err := lb.AddNode(ServerConfig{URL: url, Weight: 1})
+		g.Expect(err).NotTo(gomega.BeNil())
+	}
+}
+
+func TestAddRemoveNodeWhileServing(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer testServer.Close()
+
+	lb, err := newServerNodes(serverConfigs([]string{testServer.URL}))
+	g.Expect(err).To(gomega.BeNil())
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			serverURL := fmt.Sprintf("http://localhost:%d", 9000+i)
+			lb.AddNode(ServerConfig{URL: serverURL})
+			lb.checkDueNodes()
+			lb.RemoveNode(serverURL)
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+	<-done
+
+	g.Expect(lb.nodes()).To(gomega.HaveLen(1))
+}
+
+func TestCheckHealth(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer testServer.Close()
+
+	node := &Node{URL: &url.URL{Host: strings.TrimPrefix(testServer.URL, "http://")}}
+	unreachableNode := &Node{URL: &url.URL{Host: "example.com"}}
+
+	// without an HTTP health check, a node accepting connections is up
+	lb := &LB{}
+	g.Expect(lb.checkHealth(node)).To(gomega.BeNil())
+	g.Expect(lb.checkHealth(unreachableNode)).To(gomega.Equal(errNodeUnreachable))
+
+	// with an HTTP health check, the 500 responses make it down
+	hc, err := NewHealthCheck(HealthCheckConfig{})
+	g.Expect(err).To(gomega.BeNil())
+
+	lb = &LB{healthCheck: hc}
+	g.Expect(lb.checkHealth(node)).To(gomega.Equal(errors.New("unexpected status code 500")))
 }
 
 func TestSelectServerByCookie(t *testing.T) {
@@ -74,13 +322,21 @@ func TestSelectServerByCookie(t *testing.T) {
 	testServer := httptest.NewServer(handler)
 	defer testServer.Close()
 
+	anotherTestServer := httptest.NewServer(handler)
+	defer anotherTestServer.Close()
+
 	cookieUrl := url.URL{Host: strings.TrimPrefix(testServer.URL, "http://")}
-	anotherUrl := url.URL{Host: strings.TrimPrefix(testServer.URL, "http://")}
+	anotherUrl := url.URL{Host: strings.TrimPrefix(anotherTestServer.URL, "http://")}
 
 	activeNode1 := &Node{alive: true, URL: &anotherUrl}
 	activeNodeWithCookie := &Node{alive: true, URL: &cookieUrl}
 	activeNode3 := &Node{alive: true, URL: &anotherUrl}
 
+	signer, err := newCookieSigner([]string{"secret"})
+	g.Expect(err).To(gomega.BeNil())
+	otherSigner, err := newCookieSigner([]string{"other secret"})
+	g.Expect(err).To(gomega.BeNil())
+
 	testCases := []struct {
 		name         string
 		nodes        []*Node
@@ -91,14 +347,28 @@ func TestSelectServerByCookie(t *testing.T) {
 		{
 			name:         "cookie presents in the request - pick up the node that has same name with cookie",
 			nodes:        []*Node{activeNode1, activeNodeWithCookie, activeNode3},
-			cookie:       &http.Cookie{Value: cookieUrl.Host},
+			cookie:       &http.Cookie{Value: sessionValue(signer, activeNodeWithCookie)},
 			expectedNode: activeNodeWithCookie,
 			expectedErr:  nil,
 		},
 		{
-			name:         "cookie not present in the request - use the next available healthy node",
+			name:         "cookie of an unknown node - fail over to another available node",
+			nodes:        []*Node{activeNode1, activeNode3},
+			cookie:       &http.Cookie{Value: sessionValue(signer, activeNodeWithCookie)},
+			expectedNode: activeNode1,
+			expectedErr:  nil,
+		},
+		{
+			name:         "cookie with the node URL - use the next available healthy node",
 			nodes:        []*Node{activeNode1, activeNodeWithCookie, activeNode3},
-			cookie:       &http.Cookie{Value: "random.com"},
+			cookie:       &http.Cookie{Value: cookieUrl.String()},
+			expectedNode: activeNode1,
+			expectedErr:  nil,
+		},
+		{
+			name:         "cookie signed with another key - use the next available healthy node",
+			nodes:        []*Node{activeNode1, activeNodeWithCookie, activeNode3},
+			cookie:       &http.Cookie{Value: sessionValue(otherSigner, activeNodeWithCookie)},
 			expectedNode: activeNode1,
 			expectedErr:  nil,
 		},
@@ -107,10 +377,11 @@ func TestSelectServerByCookie(t *testing.T) {
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			w := httptest.NewRecorder()
-			lb := &LB{Nodes: tc.nodes}
-			node, err := lb.selectServerByCookie(w, tc.cookie)
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			lb := &LB{Nodes: tc.nodes, strategy: NewRoundRobin(), signer: signer}
+			node, err := lb.selectServerByCookie(w, r, tc.cookie)
 
-			g.Expect(node).To(gomega.Equal(tc.expectedNode))
+			g.Expect(node).To(gomega.BeIdenticalTo(tc.expectedNode))
 
 			if tc.expectedErr != nil {
 				g.Expect(err).To(gomega.Equal(tc.expectedErr))
@@ -140,6 +411,9 @@ func TestSelectServerByNextHealthyNode(t *testing.T) {
 	inaactiveNode1 := &Node{alive: false, URL: &inactiveUrl}
 	inaactiveNode2 := &Node{alive: false, URL: &inactiveUrl}
 
+	signer, err := newCookieSigner([]string{"secret"})
+	g.Expect(err).To(gomega.BeNil())
+
 	testCases := []struct {
 		name           string
 		nodes          []*Node
@@ -152,7 +426,7 @@ func TestSelectServerByNextHealthyNode(t *testing.T) {
 			nodes:          []*Node{activeNode1, activeNode2},
 			expectedNode:   activeNode1,
 			expectedErr:    nil,
-			expectedCookie: http.Cookie{Name: "session", Value: fmt.Sprintf("%s", activeNode2.URL)},
+			expectedCookie: http.Cookie{Name: "session", Value: signer.nodeID(activeNode2.URL)},
 		},
 		{
 			name:         "all nodes are inactive",
@@ -165,15 +439,16 @@ func TestSelectServerByNextHealthyNode(t *testing.T) {
 			nodes:          []*Node{inaactiveNode1, activeNode1},
 			expectedNode:   activeNode1,
 			expectedErr:    nil,
-			expectedCookie: http.Cookie{Name: "session", Value: fmt.Sprintf("%s", activeNode1.URL)},
+			expectedCookie: http.Cookie{Name: "session", Value: signer.nodeID(activeNode1.URL)},
 		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			lb := &LB{Nodes: tc.nodes}
+			lb := &LB{Nodes: tc.nodes, strategy: NewRoundRobin(), signer: signer}
 			w := httptest.NewRecorder()
-			node, err := lb.selectServerByNextHealthyNode(w)
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			node, err := lb.selectServerByNextHealthyNode(w, r)
 
 			if tc.expectedErr == nil {
 				cookies := w.Result().Cookies()
@@ -181,7 +456,11 @@ func TestSelectServerByNextHealthyNode(t *testing.T) {
 
 				g.Expect(len(cookies)).To(gomega.Equal(1))
 				g.Expect(cookie.Name).To(gomega.Equal(tc.expectedCookie.Name))
-				g.Expect(cookie.Value).To(gomega.Equal(tc.expectedCookie.Value))
+
+				// the cookie holds the session of the node ID
+				s, ok := lb.readSession(cookie.Value, time.Now())
+				g.Expect(ok).To(gomega.BeTrue())
+				g.Expect(s.nodeID).To(gomega.Equal(tc.expectedCookie.Value))
 			}
 
 			g.Expect(node).To(gomega.Equal(tc.expectedNode))
@@ -239,8 +518,9 @@ func TestGetNextHealthyNode(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			lb := &LB{Nodes: tc.nodes}
-			node, err := lb.getNextHealthyNode()
+			lb := &LB{Nodes: tc.nodes, strategy: NewRoundRobin()}
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			node, err := lb.getNextHealthyNode(r)
 
 			g.Expect(node).To(gomega.Equal(tc.expectedNode))
 			if tc.expectedErr != nil {
@@ -252,6 +532,61 @@ func TestGetNextHealthyNode(t *testing.T) {
 	}
 }
 
+type firstNodeStrategy struct{}
+
+func (firstNodeStrategy) Select(nodes []*Node, r *http.Request) (*Node, error) {
+	if len(nodes) == 0 {
+		return nil, ErrNoAvailableNode
+	}
+	return nodes[0], nil
+}
+
+func TestWithStrategy(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	node1 := &Node{URL: &url.URL{Host: "example.com"}}
+	node2 := &Node{URL: &url.URL{Host: "example.org"}}
+
+	lb := &LB{Nodes: []*Node{node1, node2}, strategy: NewRoundRobin()}
+	WithStrategy(firstNodeStrategy{})(lb)
+
+	for i := 0; i < 3; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		node, err := lb.getNextHealthyNode(r)
+
+		g.Expect(err).To(gomega.BeNil())
+		g.Expect(node).To(gomega.Equal(node1))
+	}
+}
+
+func TestNilStrategy(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	node1 := &Node{URL: &url.URL{Host: "example.com"}, alive: true, weight: 1}
+	node2 := &Node{URL: &url.URL{Host: "example.org"}, alive: true, weight: 1}
+
+	// both a load balancer built as a literal and one given a nil strategy fall back to
+	// weighted round robin
+	for _, lb := range []*LB{{Nodes: []*Node{node1, node2}}, {Nodes: []*Node{node1, node2}, strategy: NewRoundRobin()}} {
+		WithStrategy(nil)(lb)
+
+		selected := map[*Node]int{}
+		for i := 0; i < 4; i++ {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			node, err := lb.getNextHealthyNode(r)
+			g.Expect(err).To(gomega.BeNil())
+			selected[node]++
+		}
+
+		g.Expect(selected).To(gomega.Equal(map[*Node]int{node1: 2, node2: 2}))
+		g.Expect(lb.strategy).To(gomega.BeAssignableToTypeOf(&WeightedRoundRobin{}))
+
+		node, err := lb.selectRetryNode(httptest.NewRequest(http.MethodGet, "/", nil), map[*Node]bool{node1: true})
+		g.Expect(err).To(gomega.BeNil())
+		g.Expect(node).To(gomega.BeIdenticalTo(node2))
+	}
+}
+
 func TestSetCookie(t *testing.T) {
 	g := gomega.NewGomegaWithT(t)
 
@@ -272,7 +607,11 @@ func TestSetCookie(t *testing.T) {
 	cookie := cookies[0]
 	g.Expect(cookie.Name).To(gomega.Equal("session"))
 
-	g.Expect(cookie.Value).To(gomega.Equal("//example.com"))
+	// the cookie holds the signed ID of the node rather than its URL
+	g.Expect(cookie.Value).NotTo(gomega.ContainSubstring("example.com"))
+	s, ok := lb.readSession(cookie.Value, time.Now())
+	g.Expect(ok).To(gomega.BeTrue())
+	g.Expect(s.nodeID).To(gomega.Equal(lb.cookieSigner().nodeID(node.URL)))
 
 	// Make a new request and add the cookie
 	req, err := http.NewRequest("GET", "/", nil)
@@ -284,5 +623,103 @@ func TestSetCookie(t *testing.T) {
 	// Check if the cookie is present in the new request
 	g.Expect(len(req.Cookies())).To(gomega.Equal(1))
 	g.Expect(req.Cookies()[0].Name).To(gomega.Equal("session"))
-	g.Expect(req.Cookies()[0].Value).To(gomega.Equal("//example.com"))
+	g.Expect(req.Cookies()[0].Value).To(gomega.Equal(cookie.Value))
+}
+
+// BenchmarkServeHTTPParallel proxies requests to slow backends with an increasing number of
+// concurrent clients. Since no lock is held while proxying, ns/op should drop as clients grow.
+func BenchmarkServeHTTPParallel(b *testing.B) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond)
+	})
+
+	servers := []string{}
+	for i := 0; i < 3; i++ {
+		testServer := httptest.NewServer(handler)
+		defer testServer.Close()
+
+		servers = append(servers, testServer.URL)
+	}
+
+	lb, err := newServerNodes(serverConfigs(servers))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, node := range lb.Nodes {
+		node.SetAlive(true)
+		node.ReverseProxy.Transport = &http.Transport{MaxIdleConnsPerHost: 1024}
+	}
+
+	for _, clients := range []int{1, 4, 16, 64} {
+		b.Run(fmt.Sprintf("clients-%d", clients), func(b *testing.B) {
+			b.SetParallelism(clients)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					w := httptest.NewRecorder()
+					r := httptest.NewRequest(http.MethodGet, "/", nil)
+					lb.ServeHTTP(w, r)
+				}
+			})
+		})
+	}
+}
+
+// dialingStrategy reproduces selecting a node by dialing it on every request,
+// as done before selection relied on the status kept by the health checks.
+type dialingStrategy struct {
+	Strategy
+}
+
+func (s dialingStrategy) Select(nodes []*Node, r *http.Request) (*Node, error) {
+	node, err := s.Strategy.Select(nodes, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if !node.CheckNode() {
+		return nil, ErrNoAvailableNode
+	}
+
+	return node, nil
+}
+
+// BenchmarkServeHTTPLatency measures the per-request latency of selecting a node from its
+// cached status compared to dialing it on every request.
+func BenchmarkServeHTTPLatency(b *testing.B) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "Hello, world!")
+	}))
+	defer testServer.Close()
+
+	testCases := []struct {
+		name     string
+		strategy Strategy
+	}{
+		{
+			name:     "cached-status",
+			strategy: NewWeightedRoundRobin(),
+		},
+		{
+			name:     "dial-per-request",
+			strategy: dialingStrategy{NewWeightedRoundRobin()},
+		},
+	}
+
+	for _, tc := range testCases {
+		b.Run(tc.name, func(b *testing.B) {
+			lb, err := newServerNodes(serverConfigs([]string{testServer.URL}))
+			if err != nil {
+				b.Fatal(err)
+			}
+			WithStrategy(tc.strategy)(lb)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				w := httptest.NewRecorder()
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				lb.ServeHTTP(w, r)
+			}
+		})
+	}
 }
@@ -0,0 +1,72 @@
+package lb
+
+import "net/http"
+
+// LeastConnections is a Strategy that sends each request to the alive node with the
+// fewest requests in flight. Ties are broken in favour of the node with the highest weight.
+// A node ramping up with slow start only competes while its requests in flight stay under
+// its share of the ones of the node at full weight it competes with, so it isn't sent every
+// request just because it's idle when it comes back.
+type LeastConnections struct{}
+
+// NewLeastConnections creates a new least connections strategy.
+func NewLeastConnections() *LeastConnections {
+	return &LeastConnections{}
+}
+
+// Select returns the available node with the fewest requests in flight.
+func (lc *LeastConnections) Select(nodes []*Node, r *http.Request) (*Node, error) {
+	var full, ramping []*Node
+	for _, node := range nodes {
+		if !selectable(node, r) {
+			continue
+		}
+
+		if node.slowStartRatio() < 1 {
+			ramping = append(ramping, node)
+		} else {
+			full = append(full, node)
+		}
+	}
+
+	selected := fewestInFlight(full)
+	if selected == nil {
+		// every node is ramping up, so they compete with each other only
+		selected = fewestInFlight(ramping)
+		if selected == nil {
+			return nil, ErrNoAvailableNode
+		}
+		return selected, nil
+	}
+
+	// counting the request being sent, so an idle node warming up still gets traffic
+	share := float64(selected.InFlight() + 1)
+	candidates := []*Node{selected}
+	for _, node := range ramping {
+		if float64(node.InFlight()) < node.slowStartRatio()*share {
+			candidates = append(candidates, node)
+		}
+	}
+
+	return fewestInFlight(candidates), nil
+}
+
+// fewestInFlight returns the node with the fewest requests in flight, breaking ties in
+// favour of the highest weight then of the first node, or nil if there is no node.
+func fewestInFlight(nodes []*Node) *Node {
+	var selected *Node
+	var selectedInFlight int64
+	var selectedWeight float64
+
+	for _, node := range nodes {
+		inFlight := node.InFlight()
+		weight := node.Weight()
+		if selected == nil || inFlight < selectedInFlight || (inFlight == selectedInFlight && weight > selectedWeight) {
+			selected = node
+			selectedInFlight = inFlight
+			selectedWeight = weight
+		}
+	}
+
+	return selected
+}
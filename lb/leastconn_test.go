@@ -0,0 +1,120 @@
+package lb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bsm/gomega"
+)
+
+func TestLeastConnectionsSelect(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	newNode := func(host string, alive bool, weight float64, inFlight int64) *Node {
+		return &Node{URL: &url.URL{Host: host}, alive: alive, weight: weight, inFlight: inFlight}
+	}
+
+	busyNode := newNode("busy.com", true, 1, 5)
+	idleNode := newNode("idle.com", true, 1, 1)
+	idleHeavyNode := newNode("idle-heavy.com", true, 2, 1)
+	idleTwinNode := newNode("idle-twin.com", true, 1, 1)
+	freshNode := newNode("fresh.com", true, 1, 0)
+	lightNode := newNode("light.com", true, 0.1, 0)
+	downNode := newNode("down.com", false, 1, 0)
+
+	testCases := []struct {
+		name         string
+		nodes        []*Node
+		expectedNode *Node
+		expectedErr  error
+	}{
+		{
+			name:         "pick the node with the fewest requests in flight",
+			nodes:        []*Node{busyNode, idleNode},
+			expectedNode: idleNode,
+		},
+		{
+			name:         "a higher weight doesn't outweigh requests in flight",
+			nodes:        []*Node{idleHeavyNode, freshNode},
+			expectedNode: freshNode,
+		},
+		{
+			name:         "ties are broken by weight",
+			nodes:        []*Node{busyNode, idleNode, idleHeavyNode},
+			expectedNode: idleHeavyNode,
+		},
+		{
+			name:         "a node with a lower weight loses ties",
+			nodes:        []*Node{lightNode, freshNode},
+			expectedNode: freshNode,
+		},
+		{
+			name:         "ties of the same weight keep the first node",
+			nodes:        []*Node{idleNode, idleTwinNode},
+			expectedNode: idleNode,
+		},
+		{
+			name:         "nodes that are down are skipped",
+			nodes:        []*Node{downNode, busyNode},
+			expectedNode: busyNode,
+		},
+		{
+			name:        "all nodes are down",
+			nodes:       []*Node{downNode},
+			expectedErr: ErrNoAvailableNode,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			node, err := NewLeastConnections().Select(tc.nodes, r)
+
+			g.Expect(node).To(gomega.Equal(tc.expectedNode))
+			if tc.expectedErr != nil {
+				g.Expect(err).To(gomega.Equal(tc.expectedErr))
+			} else {
+				g.Expect(err).To(gomega.BeNil())
+			}
+		})
+	}
+}
+
+func TestLeastConnectionsSlowStart(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	slowStart := &SlowStartConfig{Window: Duration(time.Hour), MinWeightRatio: 0.1}
+	busyNode := &Node{URL: &url.URL{Host: "busy.com"}, alive: true, weight: 1, inFlight: 3, slowStart: slowStart}
+	rampingNode := &Node{URL: &url.URL{Host: "ramping.com"}, alive: true, weight: 1, slowStart: slowStart, recoveredAt: time.Now()}
+
+	lc := NewLeastConnections()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	// requests are kept in flight, the node ramping up must stay below its share of them
+	rampingRequests := 0
+	for i := 0; i < 20; i++ {
+		node, err := lc.Select([]*Node{busyNode, rampingNode}, r)
+		g.Expect(err).To(gomega.BeNil())
+		atomic.AddInt64(&node.inFlight, 1)
+		if node == rampingNode {
+			rampingRequests++
+		}
+
+		// at most its share of the requests of the busy node, plus the one just sent
+		g.Expect(float64(rampingNode.InFlight())).To(gomega.BeNumerically("<", 0.11*float64(busyNode.InFlight()+1)+1))
+	}
+
+	// an idle node warming up still gets traffic, but only a small share of it
+	g.Expect(rampingRequests).To(gomega.BeNumerically(">=", 1))
+	g.Expect(rampingRequests).To(gomega.BeNumerically("<=", 3))
+
+	// once ramped up, it competes on requests in flight again
+	rampingNode.recoveredAt = time.Now().Add(-2 * time.Hour)
+	node, err := lc.Select([]*Node{busyNode, rampingNode}, r)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(node).To(gomega.BeIdenticalTo(rampingNode))
+}
@@ -1,20 +1,98 @@
 package lb
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// latencySmoothing is the weight given to a new latency sample in the exponentially
+// weighted moving average of the node response time.
+const latencySmoothing = 0.3
+
+// failedLatencyPenalty is the lowest latency sample recorded for a proxied request that
+// failed, so that nodes answering errors quickly don't look like the fastest ones.
+const failedLatencyPenalty = time.Second
+
+// proxyResult records whether a proxied request failed, as reported by the handlers of the
+// reverse proxy.
+type proxyResult struct {
+	failed bool
+}
+
+type proxyResultKey struct{}
+
+// errNodeDraining is returned by proxy when the node started draining after it was selected.
+var errNodeDraining = errors.New("node is draining")
+
+// markProxyFailed marks the request proxied with ctx as failed.
+func markProxyFailed(ctx context.Context) {
+	if result, ok := ctx.Value(proxyResultKey{}).(*proxyResult); ok {
+		result.failed = true
+	}
+}
+
+// newNode creates a node proxying requests to the given server, whose URL must be an
+// absolute http or https URL. The node is considered alive until a health check says otherwise.
+func newNode(server ServerConfig) (*Node, error) {
+	url, err := url.Parse(server.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	if (url.Scheme != "http" && url.Scheme != "https") || url.Host == "" {
+		return nil, fmt.Errorf("invalid server url '%s', expected http(s)://host[:port]", server.URL)
+	}
+
+	weight := server.Weight
+	if weight <= 0 {
+		weight = 1 //set default weight to 1
+	}
+
+	n := &Node{
+		URL:          url,
+		ReverseProxy: httputil.NewSingleHostReverseProxy(url),
+		alive:        true,
+		weight:       weight,
+		baseWeight:   weight,
+		hcOverride:   server.HealthCheck,
+	}
+	n.ReverseProxy.ModifyResponse = n.handleProxyResponse
+	n.ReverseProxy.ErrorHandler = n.handleProxyError
+
+	return n, nil
+}
+
 // Node represents a server node with its URL, alive status, reverse proxy, and a mutex for synchronization.
 type Node struct {
 	URL          *url.URL
 	alive        bool
 	unhealthy    bool
 	weight       float64
+	baseWeight   float64
+	inFlight     int64
+	latency      float64
+	healthCheck  *HealthCheck
+	hcOverride   *HealthCheckConfig
+	nextCheck    time.Time
+	outlier      *outlierDetector
+	breaker      *circuitBreaker
+	slowStart    *SlowStartConfig
+	keepSessions bool
+	cookieIDs    []string
+	recoveredAt  time.Time
+	draining     bool
+	drained      chan struct{}
+	successes    int
+	failures     int
 	mux          sync.RWMutex
 	ReverseProxy *httputil.ReverseProxy
 }
@@ -22,9 +100,9 @@ type Node struct {
 // IsAlive returns whether the node is currently marked as alive.
 // This method uses a read-write mutex to ensure that it's thread-safe.
 func (n *Node) IsAlive() bool {
-	n.mux.Lock()
+	n.mux.RLock()
 	alive := n.alive
-	n.mux.Unlock()
+	n.mux.RUnlock()
 	return alive
 }
 
@@ -32,14 +110,255 @@ func (n *Node) IsAlive() bool {
 // It uses a RWMutex to ensure safe concurrent access to the node's alive status.
 func (n *Node) SetAlive(alive bool) {
 	n.mux.Lock()
+	if alive && !n.alive {
+		n.recoveredAt = time.Now()
+	}
 	n.alive = alive
 	n.mux.Unlock()
 }
 
+// InFlight returns the number of requests currently being proxied to the node.
+func (n *Node) InFlight() int64 {
+	return atomic.LoadInt64(&n.inFlight)
+}
+
+// Latency returns the exponentially weighted moving average of the node response time,
+// observed from both proxied requests and response time checks.
+func (n *Node) Latency() time.Duration {
+	n.mux.RLock()
+	latency := n.latency
+	n.mux.RUnlock()
+	return time.Duration(latency)
+}
+
+// observeLatency adds a response time sample to the moving average of the node latency.
+func (n *Node) observeLatency(d time.Duration) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	if n.latency == 0 {
+		n.latency = float64(d)
+		return
+	}
+	n.latency = latencySmoothing*float64(d) + (1-latencySmoothing)*n.latency
+}
+
+// proxy forwards the request to the node through its reverse proxy and keeps
+// track of the number of requests in flight and the response time while doing so.
+// Failed requests count as taking at least failedLatencyPenalty.
+// Requests refused by the circuit breaker of the node are answered with a 503, or
+// reported to the attempt when they can be retried on another node.
+// When the node started draining since it was selected, nothing is written and
+// errNodeDraining is returned so that the request goes to another node, unless draining
+// nodes keep their sessions.
+func (n *Node) proxy(w http.ResponseWriter, r *http.Request) error {
+	// the request is counted before checking the drain mode, so that a drain either sees it
+	// in flight or is seen here
+	atomic.AddInt64(&n.inFlight, 1)
+	defer func() {
+		if atomic.AddInt64(&n.inFlight, -1) == 0 {
+			n.checkDrained()
+		}
+	}()
+
+	if !n.keepSessions && n.IsDraining() {
+		return errNodeDraining
+	}
+
+	if n.breaker != nil {
+		probe, ok := n.breaker.acquire(time.Now())
+		if !ok {
+			if attempt := attemptFromContext(r.Context()); attempt != nil && !attempt.last {
+				attempt.err = errCircuitOpen
+				return nil
+			}
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return nil
+		}
+		defer n.breaker.release(probe)
+	}
+
+	result := &proxyResult{}
+	start := time.Now()
+	n.ReverseProxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), proxyResultKey{}, result)))
+
+	elapsed := time.Since(start)
+	if result.failed && elapsed < failedLatencyPenalty {
+		elapsed = failedLatencyPenalty
+	}
+	n.observeLatency(elapsed)
+
+	return nil
+}
+
+// IsEjected returns whether the node is currently ejected by outlier detection.
+func (n *Node) IsEjected() bool {
+	return n.outlier != nil && n.outlier.isEjected(time.Now())
+}
+
+// CircuitState returns the state of the circuit breaker of the node.
+// Nodes without circuit breaker are always closed.
+func (n *Node) CircuitState() CircuitState {
+	if n.breaker == nil {
+		return CircuitClosed
+	}
+	return n.breaker.currentState(time.Now())
+}
+
+// sessionIDs returns the IDs of the node in the session cookies, made with every key of the
+// load balancer, or nil if it wasn't set up.
+func (n *Node) sessionIDs() []string {
+	n.mux.RLock()
+	ids := n.cookieIDs
+	n.mux.RUnlock()
+	return ids
+}
+
+// IsDraining returns whether the node is being drained.
+func (n *Node) IsDraining() bool {
+	n.mux.RLock()
+	draining := n.draining
+	n.mux.RUnlock()
+	return draining
+}
+
+// SetDraining puts the node in drain mode or back in rotation.
+// A draining node doesn't take new requests while the ones in flight keep running.
+func (n *Node) SetDraining(draining bool) {
+	n.mux.Lock()
+	if draining && !n.draining {
+		n.drained = make(chan struct{})
+	}
+	if !draining {
+		n.drained = nil
+	}
+	n.draining = draining
+	n.mux.Unlock()
+
+	if draining {
+		log.Default().Printf("Node '%s' draining, %d requests in flight", n.URL.Host, n.InFlight())
+		n.checkDrained()
+	}
+}
+
+// Drain puts the node in drain mode and returns a channel closed once no request is in
+// flight on the node anymore.
+func (n *Node) Drain() <-chan struct{} {
+	n.SetDraining(true)
+
+	n.mux.RLock()
+	drained := n.drained
+	n.mux.RUnlock()
+	return drained
+}
+
+// IsDrained returns whether the node is draining and no request is in flight on it anymore.
+func (n *Node) IsDrained() bool {
+	return n.IsDraining() && n.InFlight() == 0
+}
+
+// checkDrained signals that the node is drained when it is draining and no request is in flight.
+func (n *Node) checkDrained() {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	if !n.draining || n.InFlight() != 0 {
+		return
+	}
+
+	select {
+	case <-n.drained:
+	default:
+		close(n.drained)
+		log.Default().Printf("Node '%s' drained", n.URL.Host)
+	}
+}
+
+// Available returns whether the node can take new requests: it is not draining and it
+// is serving.
+// Strategies should only select available nodes.
+func (n *Node) Available() bool {
+	return !n.IsDraining() && n.serving()
+}
+
+// serving returns whether the node is able to serve requests: it is alive, not ejected
+// and its circuit breaker lets requests through.
+func (n *Node) serving() bool {
+	return n.IsAlive() && !n.IsEjected() && (n.breaker == nil || n.breaker.allows(time.Now()))
+}
+
+// handleProxyResponse is the response modifier of the node reverse proxy.
+// It feeds the outcome of the request to outlier detection and the circuit breaker,
+// 5xx responses being errors.
+func (n *Node) handleProxyResponse(res *http.Response) error {
+	success := res.StatusCode < http.StatusInternalServerError
+	if !success {
+		markProxyFailed(res.Request.Context())
+	}
+	n.recordOutcome(success)
+	return nil
+}
+
+// recordOutcome feeds the outcome of a proxied request to outlier detection and the
+// circuit breaker of the node.
+func (n *Node) recordOutcome(success bool) {
+	now := time.Now()
+	if n.outlier != nil {
+		n.outlier.record(success, now)
+	}
+	if n.breaker != nil {
+		n.breaker.record(success, now)
+	}
+}
+
+// handleProxyError is the error handler of the node reverse proxy. Failing to reach the node
+// counts as a failed health check, so a node going down stops receiving traffic without
+// waiting for its next periodic check, and as an error for outlier detection and the
+// circuit breaker. Exceeding the per try timeout of a retried request only counts as an error.
+// Requests cancelled by the client are not held against the node.
+// When the request can be retried on another node, the error is reported to the attempt
+// instead of answering the client.
+func (n *Node) handleProxyError(w http.ResponseWriter, r *http.Request, err error) {
+	clientCtx := r.Context()
+	attempt := attemptFromContext(r.Context())
+	if attempt != nil {
+		clientCtx = attempt.clientCtx
+	}
+
+	if clientCtx.Err() == nil {
+		markProxyFailed(r.Context())
+		// a node slower than the per try timeout is still up, it is only held
+		// against it by outlier detection and the circuit breaker
+		if attempt == nil || !errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+			n.recordCheck(false)
+		}
+		n.recordOutcome(false)
+	}
+
+	log.Default().Printf("Proxy error on node '%s': %s", n.URL.Host, err)
+
+	if attempt != nil && !attempt.last && clientCtx.Err() == nil {
+		attempt.err = err
+		return
+	}
+
+	w.WriteHeader(http.StatusBadGateway)
+}
+
 // CheckNode checks the availability of the node by attempting to establish
-// a TCP connection to its URL. Returns true if successful, false otherwise.
+// a TCP connection to its URL within the timeout of its health check (1 second by default).
+// Returns true if successful, false otherwise.
 func (n *Node) CheckNode() bool {
-	timeout := 1 * time.Second
+	timeout := defaultHealthCheckTimeout
+	if n.healthCheck != nil {
+		timeout = n.healthCheck.timeout
+	}
+
+	return n.dial(timeout)
+}
+
+// dial reports whether a TCP connection to the node can be established within timeout.
+func (n *Node) dial(timeout time.Duration) bool {
 	conn, err := net.DialTimeout("tcp", n.URL.Host, timeout)
 	if err != nil {
 		return false
@@ -48,21 +367,124 @@ func (n *Node) CheckNode() bool {
 	return true
 }
 
+// recordCheck records the result of a health check of the node. The node is only marked
+// down after failing the unhealthy threshold of its health check in a row, and up again
+// after passing the healthy threshold in a row, so a single lost probe doesn't make it flap.
+// It returns whether the alive status of the node changed.
+func (n *Node) recordCheck(healthy bool) bool {
+	healthyThreshold, unhealthyThreshold := 1, 1
+	if n.healthCheck != nil {
+		healthyThreshold, unhealthyThreshold = n.healthCheck.healthyThreshold, n.healthCheck.unhealthyThreshold
+	}
+
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	if healthy {
+		n.failures = 0
+		n.successes++
+		if !n.alive && n.successes >= healthyThreshold {
+			n.alive = true
+			n.recoveredAt = time.Now()
+			return true
+		}
+		return false
+	}
+
+	n.successes = 0
+	n.failures++
+	if n.alive && n.failures >= unhealthyThreshold {
+		n.alive = false
+		return true
+	}
+	return false
+}
+
+// IsUnhealthy returns whether the node responded too slowly on its last response time check.
+func (n *Node) IsUnhealthy() bool {
+	n.mux.RLock()
+	unhealthy := n.unhealthy
+	n.mux.RUnlock()
+	return unhealthy
+}
+
+// Weight returns the current weight of the node, which is its base weight lowered
+// by the penalties of slow response time checks, and ramping up during the slow start
+// of a node that came back alive.
+func (n *Node) Weight() float64 {
+	n.mux.RLock()
+	weight := n.weight
+	if n.slowStart != nil && !n.recoveredAt.IsZero() {
+		weight *= n.slowStart.ratio(time.Since(n.recoveredAt))
+	}
+	n.mux.RUnlock()
+	return weight
+}
+
+// slowStartRatio returns the share of its weight the node gets while it ramps up with slow
+// start, and 1 outside of its slow start.
+func (n *Node) slowStartRatio() float64 {
+	n.mux.RLock()
+	defer n.mux.RUnlock()
+
+	if n.slowStart == nil || n.recoveredAt.IsZero() {
+		return 1
+	}
+	return n.slowStart.ratio(time.Since(n.recoveredAt))
+}
+
+// SetWeight changes the base weight of the node, which also becomes its current weight.
+func (n *Node) SetWeight(weight float64) {
+	n.mux.Lock()
+	n.baseWeight = weight
+	n.weight = weight
+	n.mux.Unlock()
+}
+
+// BaseWeight returns the weight the node was configured with.
+func (n *Node) BaseWeight() float64 {
+	n.mux.RLock()
+	weight := n.baseWeight
+	n.mux.RUnlock()
+	return weight
+}
+
+// CheckResponseTime lowers the weight of the node by 10% and marks it as unhealthy when
+// it takes longer than the slow threshold of its health check (200ms by default) to respond,
+// and restores its base weight otherwise. The node is probed with the request of its health
+// check, so with its scheme, path and headers.
 func (n *Node) CheckResponseTime() {
-	client := &http.Client{
-		Timeout: 200 * time.Millisecond,
+	hc := n.healthCheck
+	if hc == nil {
+		hc, _ = NewHealthCheck(HealthCheckConfig{})
+	}
+
+	client := *hc.client
+	client.Timeout = hc.slowThreshold
+
+	start := time.Now()
+	req, err := hc.newRequest(n)
+	var res *http.Response
+	if err == nil {
+		res, err = client.Do(req)
+	}
+	if err == nil {
+		res.Body.Close()
+		n.observeLatency(time.Since(start))
 	}
 
-	_, err := client.Get("http://" + n.URL.Host)
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
 	if err != nil {
-		// timeout after 200ms
+		// timeout after the slow threshold
 		// lower down the weight by 10%
 		n.weight -= n.weight * 0.1
 		n.unhealthy = true
 		return
 	}
 
-	// set back to 1 (highest) if the response time < 200ms
-	n.weight = 1
+	// set back to the configured base weight if the response time is below the slow threshold
+	n.weight = n.baseWeight
 	n.unhealthy = false
 }
@@ -1,14 +1,17 @@
 package lb
 
 import (
+	"context"
 	"fmt"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/bsm/gomega"
 
 	"net/http"
 	"net/http/httptest"
+	"net/http/httputil"
 	"net/url"
 	"testing"
 )
@@ -135,21 +138,53 @@ func TestCheckResponseTime(t *testing.T) {
 	testCases := []struct {
 		name              string
 		timeout           time.Duration
+		slowThreshold     time.Duration
+		weight            float64
+		baseWeight        float64
 		expectedUnhealthy bool
 		expectedWeight    float64
 	}{
+		{
+			name:              "node below a configured slow threshold",
+			timeout:           time.Duration(300 * time.Millisecond),
+			slowThreshold:     time.Second,
+			weight:            1,
+			baseWeight:        1,
+			expectedUnhealthy: false,
+			expectedWeight:    1,
+		},
 		{
 			name:              "node unhealthy",
 			timeout:           time.Duration(500 * time.Millisecond),
+			weight:            1,
+			baseWeight:        1,
 			expectedUnhealthy: true,
 			expectedWeight:    0.9,
 		},
 		{
 			name:              "node healthy",
 			timeout:           0,
+			weight:            1,
+			baseWeight:        1,
 			expectedUnhealthy: false,
 			expectedWeight:    1,
 		},
+		{
+			name:              "node with a configured weight unhealthy",
+			timeout:           time.Duration(500 * time.Millisecond),
+			weight:            3,
+			baseWeight:        3,
+			expectedUnhealthy: true,
+			expectedWeight:    2.7,
+		},
+		{
+			name:              "node with a configured weight recovers its base weight",
+			timeout:           0,
+			weight:            2.7,
+			baseWeight:        3,
+			expectedUnhealthy: false,
+			expectedWeight:    3,
+		},
 	}
 
 	for _, tc := range testCases {
@@ -167,8 +202,15 @@ func TestCheckResponseTime(t *testing.T) {
 			url.Host = strings.TrimPrefix(testServer.URL, "http://")
 
 			node := &Node{
-				URL:    url,
-				weight: 1,
+				URL:        url,
+				weight:     tc.weight,
+				baseWeight: tc.baseWeight,
+			}
+
+			if tc.slowThreshold > 0 {
+				hc, err := NewHealthCheck(HealthCheckConfig{SlowThreshold: Duration(tc.slowThreshold)})
+				g.Expect(err).To(gomega.BeNil())
+				node.healthCheck = hc
 			}
 			fmt.Println(node.weight)
 			node.CheckResponseTime()
@@ -179,3 +221,257 @@ func TestCheckResponseTime(t *testing.T) {
 		})
 	}
 }
+
+func TestCheckResponseTimeTLS(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	var probes int64
+	testServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" && r.Host == "app.example.com" && r.Header.Get("X-Probe") == "1" {
+			atomic.AddInt64(&probes, 1)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer testServer.Close()
+
+	hc, err := NewHealthCheck(HealthCheckConfig{
+		Path:          "/health",
+		Headers:       map[string]string{"Host": "app.example.com", "X-Probe": "1"},
+		SlowThreshold: Duration(time.Second),
+	})
+	g.Expect(err).To(gomega.BeNil())
+	hc.client.Transport = testServer.Client().Transport
+
+	node, err := newNode(ServerConfig{URL: testServer.URL, Weight: 1})
+	g.Expect(err).To(gomega.BeNil())
+	node.healthCheck = hc
+
+	// the probe speaks TLS to the path of the health check and times the real response
+	node.CheckResponseTime()
+	g.Expect(node.IsUnhealthy()).To(gomega.BeFalse())
+	g.Expect(atomic.LoadInt64(&probes)).To(gomega.Equal(int64(1)))
+	g.Expect(node.Latency()).To(gomega.BeNumerically(">=", 100*time.Millisecond))
+}
+
+func TestInFlight(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	received := make(chan struct{})
+	release := make(chan struct{})
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		<-release
+	}))
+	defer testServer.Close()
+
+	url, _ := url.Parse(testServer.URL)
+	node := &Node{URL: url, ReverseProxy: httputil.NewSingleHostReverseProxy(url)}
+
+	g.Expect(node.InFlight()).To(gomega.Equal(int64(0)))
+
+	done := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		go func() {
+			node.proxy(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+			done <- struct{}{}
+		}()
+	}
+
+	<-received
+	<-received
+	g.Expect(node.InFlight()).To(gomega.Equal(int64(2)))
+
+	close(release)
+	<-done
+	<-done
+	g.Expect(node.InFlight()).To(gomega.Equal(int64(0)))
+}
+
+func TestLatency(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer testServer.Close()
+
+	url, _ := url.Parse(testServer.URL)
+	node := &Node{URL: url, ReverseProxy: httputil.NewSingleHostReverseProxy(url)}
+
+	g.Expect(node.Latency()).To(gomega.Equal(time.Duration(0)))
+
+	// the latency of proxied requests is recorded
+	node.proxy(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	g.Expect(node.Latency()).To(gomega.BeNumerically(">=", 20*time.Millisecond))
+
+	// new samples are smoothed into the moving average
+	node.observeLatency(0)
+	g.Expect(node.Latency()).To(gomega.BeNumerically("<", 20*time.Millisecond))
+	g.Expect(node.Latency()).To(gomega.BeNumerically(">", 0))
+}
+
+func TestRecordCheck(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	hc, err := NewHealthCheck(HealthCheckConfig{Type: HealthCheckTCP, HealthyThreshold: 2, UnhealthyThreshold: 3})
+	g.Expect(err).To(gomega.BeNil())
+
+	testCases := []struct {
+		name           string
+		healthCheck    *HealthCheck
+		alive          bool
+		checks         []bool
+		expectedAlive  []bool
+		expectedChange []bool
+	}{
+		{
+			name:           "without thresholds a single check flips the status",
+			alive:          true,
+			checks:         []bool{false, true, false},
+			expectedAlive:  []bool{false, true, false},
+			expectedChange: []bool{true, true, true},
+		},
+		{
+			name:           "marked down after the unhealthy threshold is reached",
+			healthCheck:    hc,
+			alive:          true,
+			checks:         []bool{false, false, false},
+			expectedAlive:  []bool{true, true, false},
+			expectedChange: []bool{false, false, true},
+		},
+		{
+			name:           "a success in between resets the failures",
+			healthCheck:    hc,
+			alive:          true,
+			checks:         []bool{false, false, true, false, false},
+			expectedAlive:  []bool{true, true, true, true, true},
+			expectedChange: []bool{false, false, false, false, false},
+		},
+		{
+			name:           "marked up after the healthy threshold is reached",
+			healthCheck:    hc,
+			alive:          false,
+			checks:         []bool{true, false, true, true},
+			expectedAlive:  []bool{false, false, false, true},
+			expectedChange: []bool{false, false, false, true},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			node := &Node{URL: &url.URL{Host: "localhost:8000"}, alive: tc.alive, healthCheck: tc.healthCheck}
+
+			for i, check := range tc.checks {
+				g.Expect(node.recordCheck(check)).To(gomega.Equal(tc.expectedChange[i]))
+				g.Expect(node.IsAlive()).To(gomega.Equal(tc.expectedAlive[i]))
+			}
+		})
+	}
+}
+
+func TestHandleProxyError(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	// grab a free address and close it so connections to it are refused
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	url, _ := url.Parse(testServer.URL)
+	testServer.Close()
+
+	hc, err := NewHealthCheck(HealthCheckConfig{Type: HealthCheckTCP, UnhealthyThreshold: 2})
+	g.Expect(err).To(gomega.BeNil())
+
+	node := &Node{URL: url, alive: true, healthCheck: hc, ReverseProxy: httputil.NewSingleHostReverseProxy(url)}
+	node.ReverseProxy.ErrorHandler = node.handleProxyError
+
+	// the failed request counts as a failed check and the node is marked down after the threshold
+	w := httptest.NewRecorder()
+	node.proxy(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	g.Expect(w.Code).To(gomega.Equal(http.StatusBadGateway))
+	g.Expect(node.IsAlive()).To(gomega.BeTrue())
+
+	node.proxy(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	g.Expect(node.IsAlive()).To(gomega.BeFalse())
+
+	// requests cancelled by the client are not held against the node
+	node = &Node{URL: url, alive: true, ReverseProxy: httputil.NewSingleHostReverseProxy(url)}
+	node.ReverseProxy.ErrorHandler = node.handleProxyError
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	node.proxy(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+	g.Expect(node.IsAlive()).To(gomega.BeTrue())
+}
+
+func TestOutlierEjection(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer testServer.Close()
+
+	cfg := OutlierDetectionConfig{MaxFailures: 3}
+	g.Expect(cfg.validate()).To(gomega.BeNil())
+
+	node, err := newNode(ServerConfig{URL: testServer.URL})
+	g.Expect(err).To(gomega.BeNil())
+	node.outlier = newOutlierDetector(cfg, node.URL.Host)
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		node.proxy(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		g.Expect(w.Code).To(gomega.Equal(http.StatusServiceUnavailable))
+	}
+
+	g.Expect(node.IsEjected()).To(gomega.BeFalse())
+	g.Expect(node.Available()).To(gomega.BeTrue())
+
+	node.proxy(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	// the node is ejected while still being alive for the active health check
+	g.Expect(node.IsEjected()).To(gomega.BeTrue())
+	g.Expect(node.IsAlive()).To(gomega.BeTrue())
+	g.Expect(node.Available()).To(gomega.BeFalse())
+}
+
+func TestCircuitBreakerOpens(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	var failing int32 = 1
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer testServer.Close()
+
+	cfg := CircuitBreakerConfig{FailureThreshold: 2, Cooldown: Duration(50 * time.Millisecond)}
+	g.Expect(cfg.validate()).To(gomega.BeNil())
+
+	node, err := newNode(ServerConfig{URL: testServer.URL})
+	g.Expect(err).To(gomega.BeNil())
+	node.breaker = newCircuitBreaker(cfg, node.URL.Host)
+
+	for i := 0; i < 2; i++ {
+		node.proxy(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+
+	// the open circuit refuses requests while the node is still alive
+	g.Expect(node.CircuitState()).To(gomega.Equal(CircuitOpen))
+	g.Expect(node.IsAlive()).To(gomega.BeTrue())
+	g.Expect(node.Available()).To(gomega.BeFalse())
+
+	w := httptest.NewRecorder()
+	node.proxy(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	g.Expect(w.Code).To(gomega.Equal(http.StatusServiceUnavailable))
+
+	// after the cooldown a probe goes through and closes the circuit
+	atomic.StoreInt32(&failing, 0)
+	g.Eventually(node.Available).Should(gomega.BeTrue())
+	g.Expect(node.CircuitState()).To(gomega.Equal(CircuitHalfOpen))
+
+	w = httptest.NewRecorder()
+	node.proxy(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	g.Expect(w.Code).To(gomega.Equal(http.StatusOK))
+	g.Expect(node.CircuitState()).To(gomega.Equal(CircuitClosed))
+}
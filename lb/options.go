@@ -0,0 +1,69 @@
+package lb
+
+// Option configures optional behaviour of the load balancer.
+type Option func(*LB)
+
+// WithStrategy sets the strategy used to pick a node for each request.
+// The default is smooth weighted round robin, also used when strategy is nil.
+func WithStrategy(strategy Strategy) Option {
+	return func(lb *LB) {
+		lb.strategy = strategy
+	}
+}
+
+// WithHealthCheck sets the health check used to probe the nodes and decide when they
+// are up or down. Nodes can override its settings through ServerConfig.HealthCheck.
+// The default only checks that nodes accept TCP connections.
+func WithHealthCheck(hc *HealthCheck) Option {
+	return func(lb *LB) {
+		lb.healthCheck = hc
+	}
+}
+
+// WithOutlierDetection enables the passive health check of the nodes, ejecting the nodes
+// whose proxied requests fail too often for a while.
+func WithOutlierDetection(cfg OutlierDetectionConfig) Option {
+	return func(lb *LB) {
+		lb.outlierDetection = &cfg
+	}
+}
+
+// WithRetry sets how requests failing to reach their node are retried on another node.
+// By default idempotent requests are tried up to 3 times.
+func WithRetry(cfg RetryConfig) Option {
+	return func(lb *LB) {
+		lb.retry = &cfg
+	}
+}
+
+// WithCircuitBreaker gives every node a circuit breaker, which stops sending requests to
+// the node after consecutive failures until probe requests succeed again.
+func WithCircuitBreaker(cfg CircuitBreakerConfig) Option {
+	return func(lb *LB) {
+		lb.circuitBreaker = &cfg
+	}
+}
+
+// WithSlowStart ramps up the weight of the nodes coming back alive instead of sending them
+// their full share of traffic right away.
+func WithSlowStart(cfg SlowStartConfig) Option {
+	return func(lb *LB) {
+		lb.slowStart = &cfg
+	}
+}
+
+// WithDrain sets how draining nodes are handled.
+// By default they don't take any new request, including the ones of their sessions.
+func WithDrain(cfg DrainConfig) Option {
+	return func(lb *LB) {
+		lb.drain = &cfg
+	}
+}
+
+// WithAffinity sets how the session cookies pinning clients to a node are signed.
+// By default they are signed with a random key generated on startup.
+func WithAffinity(cfg AffinityConfig) Option {
+	return func(lb *LB) {
+		lb.affinity = &cfg
+	}
+}
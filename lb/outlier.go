@@ -0,0 +1,257 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// outlierBuckets is the number of buckets the sliding window of an outlier detector is split into.
+const outlierBuckets = 10
+
+// Default outlier detection settings.
+const (
+	defaultOutlierWindow           = 10 * time.Second
+	defaultOutlierMaxFailures      = 5
+	defaultOutlierMinRequests      = 10
+	defaultOutlierEjectionTime     = 30 * time.Second
+	defaultOutlierMaxEjectionTime  = 5 * time.Minute
+	defaultOutlierMaxEjectionPct   = 50
+	outlierMaxEjectionTimeMultiple = 10
+)
+
+// OutlierDetectionConfig configures the passive health check of the nodes of a pool, which
+// watches the proxied traffic and ejects the nodes returning too many errors.
+// Connection failures, timeouts and 5xx responses count as errors. A node is ejected when it
+// returns MaxFailures errors within Window, or when at least MinRequests were sent to it within
+// Window and the ratio of errors reaches FailureRatio. The first ejection lasts EjectionTime and
+// every ejection following it within a window doubles it, up to MaxEjectionTime.
+// With neither MaxFailures nor FailureRatio set, a node is ejected after 5 errors in 10 seconds
+// for 30 seconds, up to 5 minutes.
+// At most MaxEjectionPercent of the nodes (50% by default) are ejected at once, but at least
+// one node of a pool of several, so a failure shared by every node doesn't take the whole
+// pool out. A single node is only ejected when MaxEjectionPercent is 100.
+type OutlierDetectionConfig struct {
+	Window             Duration `json:"window,omitempty"`
+	MaxFailures        int      `json:"max_failures,omitempty"`
+	FailureRatio       float64  `json:"failure_ratio,omitempty"`
+	MinRequests        int      `json:"min_requests,omitempty"`
+	EjectionTime       Duration `json:"ejection_time,omitempty"`
+	MaxEjectionTime    Duration `json:"max_ejection_time,omitempty"`
+	MaxEjectionPercent int      `json:"max_ejection_percent,omitempty"`
+}
+
+// validate checks the configuration and fills in the default values.
+func (cfg *OutlierDetectionConfig) validate() error {
+	if cfg.Window < 0 || cfg.EjectionTime < 0 || cfg.MaxEjectionTime < 0 {
+		return errors.New("outlier detection durations can't be negative")
+	}
+
+	if cfg.MaxFailures < 0 || cfg.MinRequests < 0 {
+		return errors.New("outlier detection thresholds can't be negative")
+	}
+
+	if cfg.FailureRatio < 0 || cfg.FailureRatio > 1 {
+		return errors.New("outlier detection failure ratio must be between 0 and 1")
+	}
+
+	if cfg.MaxEjectionPercent < 0 || cfg.MaxEjectionPercent > 100 {
+		return errors.New("outlier detection max ejection percent must be between 0 and 100")
+	}
+
+	// every bucket of the window must be at least a nanosecond wide
+	if cfg.Window > 0 && cfg.Window < outlierBuckets {
+		return fmt.Errorf("outlier detection window must be at least %s", time.Duration(outlierBuckets))
+	}
+
+	if cfg.Window == 0 {
+		cfg.Window = Duration(defaultOutlierWindow)
+	}
+
+	if cfg.MaxFailures == 0 && cfg.FailureRatio == 0 {
+		cfg.MaxFailures = defaultOutlierMaxFailures
+	}
+
+	if cfg.MaxEjectionPercent == 0 {
+		cfg.MaxEjectionPercent = defaultOutlierMaxEjectionPct
+	}
+
+	if cfg.MinRequests == 0 {
+		cfg.MinRequests = defaultOutlierMinRequests
+	}
+
+	if cfg.EjectionTime == 0 {
+		cfg.EjectionTime = Duration(defaultOutlierEjectionTime)
+	}
+
+	if cfg.MaxEjectionTime == 0 {
+		cfg.MaxEjectionTime = Duration(defaultOutlierMaxEjectionTime)
+		if cfg.EjectionTime*outlierMaxEjectionTimeMultiple > cfg.MaxEjectionTime {
+			cfg.MaxEjectionTime = cfg.EjectionTime * outlierMaxEjectionTimeMultiple
+		}
+	}
+
+	if cfg.MaxEjectionTime < cfg.EjectionTime {
+		return errors.New("outlier detection max ejection time can't be lower than the ejection time")
+	}
+
+	return nil
+}
+
+// outlierBucket counts the requests and errors of a slice of the sliding window.
+type outlierBucket struct {
+	start    time.Time
+	requests int
+	failures int
+}
+
+// outlierDetector tracks the outcome of the requests proxied to a node over a sliding window
+// and decides when the node has to be ejected. The end of the ejection is stored in
+// nanoseconds so that other detectors can read it without taking the lock.
+type outlierDetector struct {
+	cfg          OutlierDetectionConfig
+	host         string
+	guard        *ejectionGuard
+	mux          sync.Mutex
+	buckets      [outlierBuckets]outlierBucket
+	ejections    int
+	ejectedUntil int64
+}
+
+// newOutlierDetector creates an outlier detector for the node at host.
+// The configuration must have been validated.
+func newOutlierDetector(cfg OutlierDetectionConfig, host string) *outlierDetector {
+	return &outlierDetector{
+		cfg:  cfg,
+		host: host,
+	}
+}
+
+// record adds the outcome of a request proxied at now to the window, and ejects the node
+// when a failure makes it cross the thresholds.
+func (od *outlierDetector) record(success bool, now time.Time) {
+	od.mux.Lock()
+	defer od.mux.Unlock()
+
+	width := time.Duration(od.cfg.Window) / outlierBuckets
+	start := now.Truncate(width)
+	bucket := &od.buckets[(start.UnixNano()/int64(width))%outlierBuckets]
+	if !bucket.start.Equal(start) {
+		*bucket = outlierBucket{start: start}
+	}
+
+	bucket.requests++
+	if success {
+		return
+	}
+	bucket.failures++
+
+	ejectedUntil := od.ejectedUntilTime()
+	if now.Before(ejectedUntil) {
+		return
+	}
+
+	requests, failures := od.count(now)
+	if !od.isOutlier(requests, failures) {
+		return
+	}
+
+	// ejections following each other closely double the ejection time
+	ejections := od.ejections + 1
+	if now.Sub(ejectedUntil) > time.Duration(od.cfg.Window) {
+		ejections = 1
+	}
+
+	ejectionTime := time.Duration(od.cfg.EjectionTime)
+	for i := 1; i < ejections && ejectionTime < time.Duration(od.cfg.MaxEjectionTime); i++ {
+		ejectionTime *= 2
+	}
+	if ejectionTime > time.Duration(od.cfg.MaxEjectionTime) {
+		ejectionTime = time.Duration(od.cfg.MaxEjectionTime)
+	}
+
+	if !od.guard.eject(od, now.Add(ejectionTime), now) {
+		return
+	}
+
+	od.ejections = ejections
+	od.buckets = [outlierBuckets]outlierBucket{}
+
+	log.Default().Printf("Node '%s' ejected for %s: %d errors out of %d requests", od.host, ejectionTime, failures, requests)
+}
+
+// count returns the number of requests and failures within the window ending at now.
+func (od *outlierDetector) count(now time.Time) (int, int) {
+	var requests, failures int
+	for _, bucket := range od.buckets {
+		if now.Sub(bucket.start) < time.Duration(od.cfg.Window) {
+			requests += bucket.requests
+			failures += bucket.failures
+		}
+	}
+	return requests, failures
+}
+
+// isOutlier reports whether the requests and failures of the window cross the thresholds.
+func (od *outlierDetector) isOutlier(requests, failures int) bool {
+	if od.cfg.MaxFailures > 0 && failures >= od.cfg.MaxFailures {
+		return true
+	}
+
+	return od.cfg.FailureRatio > 0 &&
+		requests >= od.cfg.MinRequests &&
+		float64(failures)/float64(requests) >= od.cfg.FailureRatio
+}
+
+// isEjected reports whether the node is ejected at now.
+func (od *outlierDetector) isEjected(now time.Time) bool {
+	return now.Before(od.ejectedUntilTime())
+}
+
+// ejectedUntilTime returns the end of the last ejection of the node.
+func (od *outlierDetector) ejectedUntilTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&od.ejectedUntil))
+}
+
+// ejectionGuard limits the share of the nodes of a pool ejected at once.
+type ejectionGuard struct {
+	mux        sync.Mutex
+	maxPercent int
+	nodes      func() []*Node
+}
+
+// eject ejects the node of the detector until the given time, unless too many other nodes
+// are ejected at now. A nil guard doesn't limit ejections.
+func (g *ejectionGuard) eject(od *outlierDetector, until, now time.Time) bool {
+	if g == nil {
+		atomic.StoreInt64(&od.ejectedUntil, until.UnixNano())
+		return true
+	}
+
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	nodes := g.nodes()
+	ejected := 0
+	for _, n := range nodes {
+		if n.outlier != nil && n.outlier != od && n.outlier.isEjected(now) {
+			ejected++
+		}
+	}
+
+	limit := len(nodes) * g.maxPercent / 100
+	if limit < 1 && len(nodes) > 1 {
+		limit = 1
+	}
+
+	if ejected >= limit {
+		log.Default().Printf("Node '%s' not ejected, %d of %d nodes are already ejected", od.host, ejected, len(nodes))
+		return false
+	}
+
+	atomic.StoreInt64(&od.ejectedUntil, until.UnixNano())
+	return true
+}
@@ -0,0 +1,205 @@
+package lb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bsm/gomega"
+)
+
+func TestOutlierDetectionConfigValidate(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	testCases := []struct {
+		name        string
+		cfg         OutlierDetectionConfig
+		expectedCfg OutlierDetectionConfig
+		expectedErr bool
+	}{
+		{
+			name: "defaults",
+			cfg:  OutlierDetectionConfig{},
+			expectedCfg: OutlierDetectionConfig{
+				Window:             Duration(10 * time.Second),
+				MaxFailures:        5,
+				MinRequests:        10,
+				EjectionTime:       Duration(30 * time.Second),
+				MaxEjectionTime:    Duration(5 * time.Minute),
+				MaxEjectionPercent: 50,
+			},
+		},
+		{
+			name: "failure ratio only",
+			cfg:  OutlierDetectionConfig{FailureRatio: 0.5, EjectionTime: Duration(time.Minute)},
+			expectedCfg: OutlierDetectionConfig{
+				Window:             Duration(10 * time.Second),
+				FailureRatio:       0.5,
+				MinRequests:        10,
+				EjectionTime:       Duration(time.Minute),
+				MaxEjectionTime:    Duration(10 * time.Minute),
+				MaxEjectionPercent: 50,
+			},
+		},
+		{
+			name:        "failure ratio above 1",
+			cfg:         OutlierDetectionConfig{FailureRatio: 2},
+			expectedErr: true,
+		},
+		{
+			name:        "negative window",
+			cfg:         OutlierDetectionConfig{Window: Duration(-time.Second)},
+			expectedErr: true,
+		},
+		{
+			name:        "window shorter than a nanosecond per bucket",
+			cfg:         OutlierDetectionConfig{Window: Duration(5 * time.Nanosecond)},
+			expectedErr: true,
+		},
+		{
+			name:        "max ejection percent above 100",
+			cfg:         OutlierDetectionConfig{MaxEjectionPercent: 150},
+			expectedErr: true,
+		},
+		{
+			name:        "max ejection time lower than ejection time",
+			cfg:         OutlierDetectionConfig{EjectionTime: Duration(time.Minute), MaxEjectionTime: Duration(time.Second)},
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := tc.cfg
+			err := cfg.validate()
+
+			if tc.expectedErr {
+				g.Expect(err).NotTo(gomega.BeNil())
+			} else {
+				g.Expect(err).To(gomega.BeNil())
+				g.Expect(cfg).To(gomega.Equal(tc.expectedCfg))
+			}
+		})
+	}
+}
+
+func TestOutlierDetectorMaxFailures(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	cfg := OutlierDetectionConfig{MaxFailures: 3, Window: Duration(10 * time.Second), EjectionTime: Duration(30 * time.Second)}
+	g.Expect(cfg.validate()).To(gomega.BeNil())
+
+	od := newOutlierDetector(cfg, "localhost:8081")
+	now := time.Now()
+
+	// failures spread over more than the window don't add up
+	od.record(false, now)
+	od.record(false, now.Add(time.Second))
+	od.record(false, now.Add(12*time.Second))
+	g.Expect(od.isEjected(now.Add(12 * time.Second))).To(gomega.BeFalse())
+
+	// successes don't reset the count of failures within the window
+	od.record(true, now.Add(13*time.Second))
+	od.record(false, now.Add(14*time.Second))
+	g.Expect(od.isEjected(now.Add(14 * time.Second))).To(gomega.BeFalse())
+
+	od.record(false, now.Add(15*time.Second))
+	g.Expect(od.isEjected(now.Add(15 * time.Second))).To(gomega.BeTrue())
+
+	// the node comes back once the ejection time is over
+	g.Expect(od.isEjected(now.Add(44 * time.Second))).To(gomega.BeTrue())
+	g.Expect(od.isEjected(now.Add(45 * time.Second))).To(gomega.BeFalse())
+}
+
+func TestOutlierDetectorFailureRatio(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	cfg := OutlierDetectionConfig{FailureRatio: 0.5, MinRequests: 4}
+	g.Expect(cfg.validate()).To(gomega.BeNil())
+
+	od := newOutlierDetector(cfg, "localhost:8081")
+	now := time.Now()
+
+	// not enough requests to judge the ratio
+	od.record(false, now)
+	od.record(false, now)
+	g.Expect(od.isEjected(now)).To(gomega.BeFalse())
+
+	od.record(true, now)
+	od.record(true, now)
+	od.record(true, now)
+	g.Expect(od.isEjected(now)).To(gomega.BeFalse())
+
+	// 3 failures out of 6 requests
+	od.record(false, now)
+	g.Expect(od.isEjected(now)).To(gomega.BeTrue())
+}
+
+func TestOutlierDetectorEjectionBackoff(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	cfg := OutlierDetectionConfig{MaxFailures: 1, Window: Duration(10 * time.Second), EjectionTime: Duration(10 * time.Second), MaxEjectionTime: Duration(30 * time.Second)}
+	g.Expect(cfg.validate()).To(gomega.BeNil())
+
+	od := newOutlierDetector(cfg, "localhost:8081")
+	now := time.Now()
+
+	expectedEjectionTimes := []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second, 30 * time.Second}
+	for _, ejectionTime := range expectedEjectionTimes {
+		od.record(false, now)
+		g.Expect(od.isEjected(now.Add(ejectionTime - time.Millisecond))).To(gomega.BeTrue())
+		g.Expect(od.isEjected(now.Add(ejectionTime))).To(gomega.BeFalse())
+
+		// failing again right after coming back
+		now = now.Add(ejectionTime)
+	}
+
+	// a node failing long after its last ejection starts over
+	now = now.Add(time.Minute)
+	od.record(false, now)
+	g.Expect(od.isEjected(now.Add(10 * time.Second))).To(gomega.BeFalse())
+}
+
+func TestOutlierDetectorMaxEjectionPercent(t *testing.T) {
+	testCases := []struct {
+		name             string
+		nodes            int
+		maxPercent       int
+		expectedEjection int
+	}{
+		{name: "single node", nodes: 1, maxPercent: 50, expectedEjection: 0},
+		{name: "at least one node", nodes: 3, maxPercent: 10, expectedEjection: 1},
+		{name: "half of the nodes", nodes: 4, maxPercent: 50, expectedEjection: 2},
+		{name: "every node", nodes: 2, maxPercent: 100, expectedEjection: 2},
+		{name: "single node with every node allowed", nodes: 1, maxPercent: 100, expectedEjection: 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			g := gomega.NewGomegaWithT(t)
+
+			cfg := OutlierDetectionConfig{MaxFailures: 1, MaxEjectionPercent: tc.maxPercent}
+			g.Expect(cfg.validate()).To(gomega.BeNil())
+
+			nodes := make([]*Node, tc.nodes)
+			guard := &ejectionGuard{maxPercent: cfg.MaxEjectionPercent, nodes: func() []*Node { return nodes }}
+			for i := range nodes {
+				nodes[i] = &Node{outlier: newOutlierDetector(cfg, "localhost")}
+				nodes[i].outlier.guard = guard
+			}
+
+			// every node fails at once
+			now := time.Now()
+			for _, n := range nodes {
+				n.outlier.record(false, now)
+			}
+
+			ejected := 0
+			for _, n := range nodes {
+				if n.outlier.isEjected(now) {
+					ejected++
+				}
+			}
+			g.Expect(ejected).To(gomega.Equal(tc.expectedEjection))
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package lb
+
+import (
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// PowerOfTwoChoices is a Strategy that samples two alive nodes at random and picks the one
+// with the lower load score. The score of a node is its latency moving average multiplied by
+// the number of requests in flight, so slow or busy nodes are avoided without having to
+// compare every node of the pool.
+type PowerOfTwoChoices struct {
+	mux  sync.Mutex
+	rand *rand.Rand
+}
+
+// NewPowerOfTwoChoices creates a new power of two random choices strategy.
+func NewPowerOfTwoChoices() *PowerOfTwoChoices {
+	return &PowerOfTwoChoices{
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Select returns the least loaded of two randomly chosen alive nodes.
+func (p *PowerOfTwoChoices) Select(nodes []*Node, r *http.Request) (*Node, error) {
+	candidates := make([]*Node, 0, len(nodes))
+	for _, node := range nodes {
+		if selectable(node, r) {
+			candidates = append(candidates, node)
+		}
+	}
+
+	switch len(candidates) {
+	case 0:
+		return nil, ErrNoAvailableNode
+	case 1:
+		return candidates[0], nil
+	}
+
+	p.mux.Lock()
+	i := p.rand.Intn(len(candidates))
+	j := p.rand.Intn(len(candidates) - 1)
+	p.mux.Unlock()
+
+	// shift the second pick so both picks are distinct
+	if j >= i {
+		j++
+	}
+
+	first, second := candidates[i], candidates[j]
+	if loadScore(second) < loadScore(first) {
+		return second, nil
+	}
+
+	return first, nil
+}
+
+// loadScore returns the latency moving average of the node weighted by its requests in flight.
+// Idle nodes are scored by latency alone, and nodes without latency samples score 0 so they
+// get traffic to measure them.
+func loadScore(node *Node) float64 {
+	return float64(node.Latency()) * float64(node.InFlight()+1)
+}
@@ -0,0 +1,128 @@
+package lb
+
+import (
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/bsm/gomega"
+)
+
+func TestPowerOfTwoChoicesSelect(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	newNode := func(host string, alive bool, latency time.Duration, inFlight int64) *Node {
+		return &Node{URL: &url.URL{Host: host}, alive: alive, latency: float64(latency), inFlight: inFlight}
+	}
+
+	fastNode := newNode("fast.com", true, 10*time.Millisecond, 0)
+	slowNode := newNode("slow.com", true, 100*time.Millisecond, 0)
+	busyNode := newNode("busy.com", true, 10*time.Millisecond, 20)
+	downNode := newNode("down.com", false, time.Millisecond, 0)
+
+	testCases := []struct {
+		name         string
+		nodes        []*Node
+		expectedNode *Node
+		expectedErr  error
+	}{
+		{
+			name:         "pick the node with the lower latency",
+			nodes:        []*Node{slowNode, fastNode},
+			expectedNode: fastNode,
+		},
+		{
+			name:         "latency is weighted by requests in flight",
+			nodes:        []*Node{busyNode, slowNode},
+			expectedNode: slowNode,
+		},
+		{
+			name:         "nodes that are down are never sampled",
+			nodes:        []*Node{downNode, slowNode},
+			expectedNode: slowNode,
+		},
+		{
+			name:        "all nodes are down",
+			nodes:       []*Node{downNode},
+			expectedErr: ErrNoAvailableNode,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p2c := NewPowerOfTwoChoices()
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+			for i := 0; i < 10; i++ {
+				node, err := p2c.Select(tc.nodes, r)
+
+				g.Expect(node).To(gomega.Equal(tc.expectedNode))
+				if tc.expectedErr != nil {
+					g.Expect(err).To(gomega.Equal(tc.expectedErr))
+				} else {
+					g.Expect(err).To(gomega.BeNil())
+				}
+			}
+		})
+	}
+}
+
+func TestPowerOfTwoChoicesAvoidsSlowestNode(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	nodes := []*Node{}
+	for _, latency := range []time.Duration{1, 2, 3, 4} {
+		nodes = append(nodes, &Node{URL: &url.URL{Host: "example.com"}, alive: true, latency: float64(latency * time.Millisecond)})
+	}
+
+	p2c := &PowerOfTwoChoices{rand: rand.New(rand.NewSource(1))}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	hits := map[*Node]int{}
+	for i := 0; i < 1000; i++ {
+		node, err := p2c.Select(nodes, r)
+		g.Expect(err).To(gomega.BeNil())
+		hits[node]++
+	}
+
+	// the slowest node always loses its comparison and the fastest always wins
+	g.Expect(hits[nodes[3]]).To(gomega.Equal(0))
+	g.Expect(hits[nodes[0]]).To(gomega.BeNumerically(">", hits[nodes[1]]))
+	g.Expect(hits[nodes[1]]).To(gomega.BeNumerically(">", hits[nodes[2]]))
+}
+
+func TestPowerOfTwoChoicesAvoidsFailingNode(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("ok"))
+	}))
+	defer healthy.Close()
+
+	lb, err := newServerNodes(serverConfigs([]string{failing.URL, healthy.URL}))
+	g.Expect(err).To(gomega.BeNil())
+	WithStrategy(NewPowerOfTwoChoices())(lb)
+	g.Expect(lb.setupNodes()).To(gomega.BeNil())
+
+	// fast 5xx responses are recorded as slow samples
+	failingNode := lb.Node(failing.URL)
+	failingNode.proxy(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	g.Expect(failingNode.Latency()).To(gomega.BeNumerically(">=", failedLatencyPenalty))
+
+	statuses := map[int]int{}
+	for i := 0; i < 100; i++ {
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		statuses[w.Code]++
+	}
+	g.Expect(statuses[http.StatusOK]).To(gomega.BeNumerically(">=", 95))
+}
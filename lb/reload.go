@@ -0,0 +1,240 @@
+package lb
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Reload updates the nodes of the load balancer to match the given servers.
+// Nodes of servers still in the list keep their health state and get their new weight,
+// nodes whose health check settings changed are replaced by fresh ones, nodes of new servers
+// are added, and nodes of servers no longer in the list are drained then removed once no
+// request is in flight on them anymore, or after the drain timeout.
+// Nothing is changed when one of the servers is invalid.
+func (lb *LB) Reload(servers []ServerConfig) error {
+	// prepare every node first so an invalid server leaves the current nodes untouched
+	wanted, order, err := lb.prepareNodes(servers)
+	if err != nil {
+		return err
+	}
+
+	// check the nodes of new servers and the ones replacing nodes before they take traffic
+	fresh := []*Node{}
+	for key, n := range wanted {
+		current := lb.Node(key)
+		if current == nil || !reflect.DeepEqual(current.hcOverride, n.hcOverride) {
+			fresh = append(fresh, n)
+		}
+	}
+	lb.checkNewNodes(fresh)
+
+	lb.mux.Lock()
+	defer lb.mux.Unlock()
+
+	var added, updated, removed int
+	nodes := make([]*Node, 0, len(lb.Nodes)+len(wanted))
+	for _, current := range lb.Nodes {
+		key := current.URL.String()
+		n, ok := wanted[key]
+		if !ok {
+			// keep removed nodes until they are drained
+			nodes = append(nodes, current)
+			if _, pending := lb.pendingRemoval[current]; !pending {
+				lb.removeWhenDrained(current)
+				removed++
+			}
+			continue
+		}
+		delete(wanted, key)
+
+		if _, pending := lb.pendingRemoval[current]; pending {
+			delete(lb.pendingRemoval, current)
+			current.SetDraining(false)
+		}
+
+		if !reflect.DeepEqual(current.hcOverride, n.hcOverride) {
+			nodes = append(nodes, n)
+			updated++
+			continue
+		}
+
+		if current.BaseWeight() != n.BaseWeight() {
+			current.SetWeight(n.BaseWeight())
+			updated++
+		}
+		nodes = append(nodes, current)
+	}
+
+	for _, key := range order {
+		if n, ok := wanted[key]; ok {
+			nodes = append(nodes, n)
+			added++
+		}
+	}
+
+	lb.Nodes = nodes
+	lb.indexNodeIDsLocked()
+
+	log.Default().Printf("Servers reloaded: %d added, %d updated, %d removed", added, updated, removed)
+
+	return nil
+}
+
+// prepareNodes creates the nodes of the servers, set up with the settings of the load
+// balancer, keyed by URL and in the order of the servers.
+func (lb *LB) prepareNodes(servers []ServerConfig) (map[string]*Node, []string, error) {
+	nodes := map[string]*Node{}
+	order := []string{}
+	for _, server := range servers {
+		n, err := newNode(server)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		key := n.URL.String()
+		if _, ok := nodes[key]; ok {
+			return nil, nil, fmt.Errorf("duplicate server '%s'", key)
+		}
+
+		if err := lb.setupNode(n); err != nil {
+			return nil, nil, err
+		}
+
+		nodes[key] = n
+		order = append(order, key)
+	}
+
+	return nodes, order, nil
+}
+
+// removeWhenDrained drains the node and removes it from the load balancer once it is
+// drained, unless a reload brings it back, it is removed through RemoveNode or the load
+// balancer is stopped meanwhile.
+// The lock must be held.
+func (lb *LB) removeWhenDrained(n *Node) {
+	if lb.pendingRemoval == nil {
+		lb.pendingRemoval = map[*Node]struct{}{}
+	}
+	lb.pendingRemoval[n] = struct{}{}
+
+	drained := n.Drain()
+	timeout := lb.drainTimeout()
+	done := lb.stoppedLocked()
+
+	go func() {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		select {
+		case <-done:
+			return
+		case <-drained:
+		case <-timer.C:
+			log.Default().Printf("Node '%s' still has %d requests in flight after %s, removing it anyway", n.URL.Host, n.InFlight(), timeout)
+		}
+
+		lb.mux.Lock()
+		defer lb.mux.Unlock()
+
+		// the node itself is removed, not a node added back with its URL meanwhile
+		if _, pending := lb.pendingRemoval[n]; pending {
+			delete(lb.pendingRemoval, n)
+			lb.removeNodeLocked(n)
+		}
+	}()
+}
+
+// ConfigWatcher reloads the servers of a load balancer when its configuration file changes.
+// Only the servers are reloaded, changing the other settings of the pool requires a restart.
+type ConfigWatcher struct {
+	apply    func(data []byte) error
+	done     chan struct{}
+	path     string
+	interval time.Duration
+	mux      sync.Mutex
+	last     []byte
+}
+
+// NewConfigWatcher creates a watcher of the configuration file at path, checking it for
+// changes at the given interval. The current content of the file is considered applied.
+func NewConfigWatcher(lb *LB, path string, interval time.Duration) *ConfigWatcher {
+	return newConfigWatcher(lb.reloadConfig, lb.stopped(), path, interval)
+}
+
+// newConfigWatcher creates a watcher applying the content of the file with apply, until done is closed.
+func newConfigWatcher(apply func(data []byte) error, done chan struct{}, path string, interval time.Duration) *ConfigWatcher {
+	last, _ := os.ReadFile(path)
+
+	return &ConfigWatcher{
+		apply:    apply,
+		done:     done,
+		path:     path,
+		interval: interval,
+		last:     last,
+	}
+}
+
+// reloadConfig reloads the servers of a configuration file of the load balancer.
+func (lb *LB) reloadConfig(data []byte) error {
+	cfg, err := ParseConfig(data)
+	if err != nil {
+		return err
+	}
+
+	if _, err := cfg.Options(); err != nil {
+		return err
+	}
+
+	return lb.Reload(cfg.Servers)
+}
+
+// Run periodically checks the configuration file and reloads the servers when it changed,
+// until the load balancer or router is stopped.
+func (cw *ConfigWatcher) Run() {
+	ticker := time.NewTicker(cw.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cw.done:
+			return
+		case <-ticker.C:
+			cw.load(false)
+		}
+	}
+}
+
+// Reload reloads the servers from the configuration file, even if it didn't change.
+// An invalid file is rejected and the current servers stay active.
+func (cw *ConfigWatcher) Reload() error {
+	return cw.load(true)
+}
+
+// load reads the configuration file and applies it when it changed or when forced.
+func (cw *ConfigWatcher) load(force bool) error {
+	cw.mux.Lock()
+	defer cw.mux.Unlock()
+
+	data, err := os.ReadFile(cw.path)
+	if err != nil {
+		log.Default().Printf("Failed to read config '%s', keeping the current one: %s", cw.path, err)
+		return err
+	}
+
+	if !force && bytes.Equal(data, cw.last) {
+		return nil
+	}
+	cw.last = data
+
+	if err := cw.apply(data); err != nil {
+		log.Default().Printf("Invalid config '%s', keeping the current one: %s", cw.path, err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,193 @@
+package lb
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bsm/gomega"
+)
+
+func nodeURLs(nodes []*Node) []string {
+	urls := []string{}
+	for _, n := range nodes {
+		urls = append(urls, n.URL.String())
+	}
+	return urls
+}
+
+func TestReload(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	lb, err := newServerNodes(serverConfigs([]string{"http://localhost:8081", "http://localhost:8082", "http://localhost:8083"}))
+	g.Expect(err).To(gomega.BeNil())
+
+	kept, replaced, removed := lb.Nodes[0], lb.Nodes[1], lb.Nodes[2]
+	kept.SetAlive(false)
+
+	err = lb.Reload([]ServerConfig{
+		{URL: "http://localhost:8081", Weight: 3},
+		{URL: "http://localhost:8082", Weight: 1, HealthCheck: &HealthCheckConfig{Path: "/health"}},
+		{URL: "http://localhost:8084", Weight: 1},
+	})
+	g.Expect(err).To(gomega.BeNil())
+
+	// unchanged nodes keep their health state and get their new weight
+	g.Expect(lb.Node("http://localhost:8081")).To(gomega.BeIdenticalTo(kept))
+	g.Expect(kept.IsAlive()).To(gomega.BeFalse())
+	g.Expect(kept.BaseWeight()).To(gomega.Equal(3.0))
+
+	// nodes with new health check settings are replaced
+	g.Expect(lb.Node("http://localhost:8082")).NotTo(gomega.BeIdenticalTo(replaced))
+	g.Expect(lb.Node("http://localhost:8082").healthCheck.path).To(gomega.Equal("/health"))
+
+	g.Expect(lb.Node("http://localhost:8084")).NotTo(gomega.BeNil())
+
+	// removed nodes are drained then removed
+	g.Expect(removed.IsDraining()).To(gomega.BeTrue())
+	g.Eventually(func() []string { return nodeURLs(lb.nodes()) }).Should(gomega.Equal([]string{
+		"http://localhost:8081", "http://localhost:8082", "http://localhost:8084",
+	}))
+}
+
+func TestReloadChecksNewNodes(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	lb, err := newServerNodes(serverConfigs([]string{"http://127.0.0.1:9"}))
+	g.Expect(err).To(gomega.BeNil())
+	kept := lb.Nodes[0]
+
+	g.Expect(lb.Reload(serverConfigs([]string{"http://127.0.0.1:9", "http://127.0.0.1:19"}))).To(gomega.Succeed())
+
+	// kept nodes are left to the periodic health check
+	g.Expect(kept.IsAlive()).To(gomega.BeTrue())
+	g.Expect(lb.Node("http://127.0.0.1:19").IsAlive()).To(gomega.BeFalse())
+}
+
+func TestReloadInvalid(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	testCases := []struct {
+		name    string
+		servers []ServerConfig
+	}{
+		{
+			name:    "duplicate server",
+			servers: []ServerConfig{{URL: "http://localhost:8081", Weight: 1}, {URL: "http://localhost:8081", Weight: 2}},
+		},
+		{
+			name:    "invalid health check",
+			servers: []ServerConfig{{URL: "http://localhost:8083", Weight: 1, HealthCheck: &HealthCheckConfig{BodyRegex: "("}}},
+		},
+		{
+			name:    "invalid url",
+			servers: []ServerConfig{{URL: "http://local host", Weight: 1}},
+		},
+		{
+			name:    "url without scheme",
+			servers: []ServerConfig{{URL: "localhost:9", Weight: 1}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			lb, err := newServerNodes(serverConfigs([]string{"http://localhost:8081", "http://localhost:8082"}))
+			g.Expect(err).To(gomega.BeNil())
+			nodes := lb.Nodes
+
+			g.Expect(lb.Reload(tc.servers)).NotTo(gomega.BeNil())
+			g.Expect(lb.Nodes).To(gomega.Equal(nodes))
+			g.Expect(lb.Nodes[0].IsDraining()).To(gomega.BeFalse())
+		})
+	}
+}
+
+func TestReloadBringsBackRemovedNode(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	lb, err := newServerNodes(serverConfigs([]string{"http://localhost:8081", "http://localhost:8082"}))
+	g.Expect(err).To(gomega.BeNil())
+
+	// a request in flight keeps the removed node draining
+	removed := lb.Nodes[1]
+	atomic.AddInt64(&removed.inFlight, 1)
+
+	g.Expect(lb.Reload(serverConfigs([]string{"http://localhost:8081"}))).To(gomega.BeNil())
+	g.Expect(removed.IsDraining()).To(gomega.BeTrue())
+	g.Expect(lb.Nodes).To(gomega.ContainElement(removed))
+
+	g.Expect(lb.Reload(serverConfigs([]string{"http://localhost:8081", "http://localhost:8082"}))).To(gomega.BeNil())
+	g.Expect(removed.IsDraining()).To(gomega.BeFalse())
+
+	atomic.AddInt64(&removed.inFlight, -1)
+	removed.checkDrained()
+	g.Consistently(func() *Node { return lb.Node("http://localhost:8082") }, 50*time.Millisecond).Should(gomega.BeIdenticalTo(removed))
+}
+
+func TestReloadKeepsNodeAddedBack(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	lb, err := newServerNodes(serverConfigs([]string{"http://localhost:8081", "http://localhost:8082"}))
+	g.Expect(err).To(gomega.BeNil())
+
+	// a request in flight keeps the removed node draining
+	removed := lb.Nodes[1]
+	atomic.AddInt64(&removed.inFlight, 1)
+	g.Expect(lb.Reload(serverConfigs([]string{"http://localhost:8081"}))).To(gomega.BeNil())
+
+	// the admin API deletes the node and adds its URL back during the drain
+	_, err = lb.RemoveNode("http://localhost:8082")
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(lb.pendingRemoval).NotTo(gomega.HaveKey(removed))
+	added, err := lb.AddNode(ServerConfig{URL: "http://localhost:8082", Weight: 1})
+	g.Expect(err).To(gomega.BeNil())
+
+	atomic.AddInt64(&removed.inFlight, -1)
+	removed.checkDrained()
+	g.Consistently(func() *Node { return lb.Node("http://localhost:8082") }, 50*time.Millisecond).Should(gomega.BeIdenticalTo(added))
+}
+
+func TestReloadDrainTimeout(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	lb, err := newServerNodes(serverConfigs([]string{"http://localhost:8081", "http://localhost:8082"}))
+	g.Expect(err).To(gomega.BeNil())
+	WithDrain(DrainConfig{Timeout: Duration(50 * time.Millisecond)})(lb)
+
+	// the node is removed after the timeout even with a request still in flight
+	atomic.AddInt64(&lb.Nodes[1].inFlight, 1)
+	g.Expect(lb.Reload(serverConfigs([]string{"http://localhost:8081"}))).To(gomega.BeNil())
+	g.Eventually(func() []string { return nodeURLs(lb.nodes()) }).Should(gomega.Equal([]string{"http://localhost:8081"}))
+}
+
+func TestConfigWatcher(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	path := filepath.Join(t.TempDir(), "serverlist.json")
+	g.Expect(os.WriteFile(path, []byte(`["http://localhost:8081"]`), 0o644)).To(gomega.Succeed())
+
+	lb, err := newServerNodes(serverConfigs([]string{"http://localhost:8081"}))
+	g.Expect(err).To(gomega.BeNil())
+	cw := NewConfigWatcher(lb, path, time.Hour)
+
+	// unchanged file
+	g.Expect(cw.load(false)).To(gomega.Succeed())
+	g.Expect(nodeURLs(lb.Nodes)).To(gomega.Equal([]string{"http://localhost:8081"}))
+
+	g.Expect(os.WriteFile(path, []byte(`{"servers": ["http://localhost:8081", "http://localhost:8082"]}`), 0o644)).To(gomega.Succeed())
+	g.Expect(cw.load(false)).To(gomega.Succeed())
+	g.Expect(nodeURLs(lb.Nodes)).To(gomega.Equal([]string{"http://localhost:8081", "http://localhost:8082"}))
+
+	// invalid files are rejected and the current servers stay active
+	for _, content := range []string{`{"servers": [`, `[]`, `{"servers": ["http://localhost:8081"], "retry": {"max_attempts": -1}}`} {
+		g.Expect(os.WriteFile(path, []byte(content), 0o644)).To(gomega.Succeed())
+		g.Expect(cw.load(false)).NotTo(gomega.Succeed())
+		g.Expect(nodeURLs(lb.Nodes)).To(gomega.Equal([]string{"http://localhost:8081", "http://localhost:8082"}))
+		g.Expect(lb.Nodes[1].IsDraining()).To(gomega.BeFalse())
+	}
+
+	g.Expect(os.Remove(path)).To(gomega.Succeed())
+	g.Expect(cw.Reload()).NotTo(gomega.Succeed())
+}
@@ -0,0 +1,215 @@
+package lb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Default retry settings.
+const (
+	defaultRetryMaxAttempts = 3
+	defaultRetryMaxBodySize = 64 * 1024
+)
+
+// RetryConfig configures how requests failing to reach their node are retried on another node.
+// Only GET, HEAD and OPTIONS requests are retried, plus the methods listed in Methods.
+// A request is tried at most MaxAttempts times in total, each try being cancelled after
+// PerTryTimeout if set. Request bodies up to MaxBodySize bytes are buffered so they can be
+// sent again, requests with bigger bodies are not retried.
+// Zero values fall back to 3 attempts, no per-try timeout and bodies up to 64KiB.
+// Setting MaxAttempts to 1 disables retries.
+type RetryConfig struct {
+	MaxAttempts   int      `json:"max_attempts,omitempty"`
+	PerTryTimeout Duration `json:"per_try_timeout,omitempty"`
+	MaxBodySize   int64    `json:"max_body_size,omitempty"`
+	Methods       []string `json:"methods,omitempty"`
+}
+
+// validate checks the configuration and fills in the default values.
+func (cfg *RetryConfig) validate() error {
+	if cfg.MaxAttempts < 0 || cfg.MaxBodySize < 0 || cfg.PerTryTimeout < 0 {
+		return errors.New("retry settings can't be negative")
+	}
+
+	if cfg.MaxAttempts == 0 {
+		cfg.MaxAttempts = defaultRetryMaxAttempts
+	}
+
+	if cfg.MaxBodySize == 0 {
+		cfg.MaxBodySize = defaultRetryMaxBodySize
+	}
+
+	return nil
+}
+
+// allowsMethod reports whether requests with the given method can be retried.
+func (cfg *RetryConfig) allowsMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+
+	for _, allowed := range cfg.Methods {
+		if strings.EqualFold(allowed, method) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// proxyAttempt is attached to the context of a request being proxied when it can be
+// retried, so that the error handler of the node reports the failure instead of answering
+// unless it is the last attempt.
+type proxyAttempt struct {
+	clientCtx context.Context
+	last      bool
+	err       error
+}
+
+type proxyAttemptKey struct{}
+
+// attemptFromContext returns the attempt attached to the context, or nil if there is none.
+func attemptFromContext(ctx context.Context) *proxyAttempt {
+	attempt, _ := ctx.Value(proxyAttemptKey{}).(*proxyAttempt)
+	return attempt
+}
+
+// serveWithRetry proxies the request to node, and to other nodes picked by the strategy
+// as long as the request fails to reach them and attempts are left.
+func (lb *LB) serveWithRetry(w http.ResponseWriter, r *http.Request, node *Node, cfg *RetryConfig) {
+	body, ok := bufferBody(r, cfg.MaxBodySize)
+	if !ok {
+		lb.proxy(w, r, node)
+		return
+	}
+
+	tried := map[*Node]bool{}
+	for attempt := 1; ; attempt++ {
+		tried[node] = true
+
+		// the last attempt answers the client with the error itself
+		err := lb.tryNode(w, r, node, body, cfg, attempt == cfg.MaxAttempts)
+		if err == nil {
+			return
+		}
+
+		// the request didn't leave the load balancer, so it doesn't use up an attempt
+		if errors.Is(err, errNodeDraining) {
+			attempt--
+		}
+
+		next, selectErr := lb.selectRetryNode(r, tried)
+		if selectErr != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		// keep the session on the node that is actually serving the request
+		lb.repin(w, r, next)
+
+		node = next
+	}
+}
+
+// tryNode proxies one attempt of the request to node. Unless it is the last attempt, it
+// returns the error that prevented the request from reaching the node, in which case
+// nothing has been written to w.
+func (lb *LB) tryNode(w http.ResponseWriter, r *http.Request, node *Node, body []byte, cfg *RetryConfig, last bool) error {
+	attempt := &proxyAttempt{clientCtx: r.Context(), last: last}
+	ctx := context.WithValue(r.Context(), proxyAttemptKey{}, attempt)
+
+	if cfg.PerTryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(cfg.PerTryTimeout))
+		defer cancel()
+	}
+
+	if err := node.proxy(w, withBody(r.WithContext(ctx), body)); err != nil {
+		return err
+	}
+
+	return attempt.err
+}
+
+// selectRetryNode picks another node for the request among the ones not tried yet.
+// The strategy sees every node of the pool, so that its state, such as the ring of the
+// consistent hash, isn't rebuilt for every retry, and skips the tried nodes through the
+// context of the request. Strategies returning a tried node anyway are asked again with
+// the nodes not tried yet only.
+func (lb *LB) selectRetryNode(r *http.Request, tried map[*Node]bool) (*Node, error) {
+	strategy := lb.balancingStrategy()
+	nodes := lb.nodes()
+	node, err := strategy.Select(nodes, r.WithContext(context.WithValue(r.Context(), excludedNodesKey{}, tried)))
+	if err != nil || !tried[node] {
+		return node, err
+	}
+
+	untried := []*Node{}
+	for _, node := range nodes {
+		if !tried[node] {
+			untried = append(untried, node)
+		}
+	}
+
+	return strategy.Select(untried, r)
+}
+
+type excludedNodesKey struct{}
+
+// isExcluded reports whether the node is excluded from the selection of the request,
+// because the request already tried it.
+func isExcluded(r *http.Request, node *Node) bool {
+	if r == nil {
+		return false
+	}
+
+	excluded, _ := r.Context().Value(excludedNodesKey{}).(map[*Node]bool)
+	return excluded[node]
+}
+
+// bufferBody reads the request body so it can be sent again on every attempt.
+// It returns false when the body is bigger than maxSize, in which case the request body
+// is restored so the request can still be proxied once.
+func bufferBody(r *http.Request, maxSize int64) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSize+1))
+	if err != nil || int64(len(body)) > maxSize {
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil, false
+	}
+
+	r.Body.Close()
+
+	return body, true
+}
+
+// withBody returns a shallow copy of the request sending body.
+func withBody(r *http.Request, body []byte) *http.Request {
+	if body == nil {
+		return r
+	}
+
+	req := r.Clone(r.Context())
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+
+	return req
+}
+
+// readCloser reads from a reader and closes a separate closer.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,262 @@
+package lb
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bsm/gomega"
+)
+
+func TestRetryConfigValidate(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	testCases := []struct {
+		name        string
+		cfg         RetryConfig
+		expectedCfg RetryConfig
+		expectedErr bool
+	}{
+		{
+			name:        "defaults",
+			cfg:         RetryConfig{},
+			expectedCfg: RetryConfig{MaxAttempts: 3, MaxBodySize: 64 * 1024},
+		},
+		{
+			name:        "custom",
+			cfg:         RetryConfig{MaxAttempts: 1, MaxBodySize: 10, PerTryTimeout: Duration(time.Second)},
+			expectedCfg: RetryConfig{MaxAttempts: 1, MaxBodySize: 10, PerTryTimeout: Duration(time.Second)},
+		},
+		{
+			name:        "negative attempts",
+			cfg:         RetryConfig{MaxAttempts: -1},
+			expectedErr: true,
+		},
+		{
+			name:        "negative per try timeout",
+			cfg:         RetryConfig{PerTryTimeout: Duration(-time.Second)},
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := tc.cfg
+			err := cfg.validate()
+
+			if tc.expectedErr {
+				g.Expect(err).NotTo(gomega.BeNil())
+			} else {
+				g.Expect(err).To(gomega.BeNil())
+				g.Expect(cfg).To(gomega.Equal(tc.expectedCfg))
+			}
+		})
+	}
+}
+
+func TestRetryConfigAllowsMethod(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	cfg := RetryConfig{Methods: []string{"put"}}
+
+	g.Expect(cfg.allowsMethod(http.MethodGet)).To(gomega.BeTrue())
+	g.Expect(cfg.allowsMethod(http.MethodHead)).To(gomega.BeTrue())
+	g.Expect(cfg.allowsMethod(http.MethodOptions)).To(gomega.BeTrue())
+	g.Expect(cfg.allowsMethod(http.MethodPut)).To(gomega.BeTrue())
+	g.Expect(cfg.allowsMethod(http.MethodPost)).To(gomega.BeFalse())
+}
+
+// newRetryTestLB returns a load balancer with a node that can't be reached followed by
+// a node echoing the request body.
+func newRetryTestLB(t *testing.T, cfg RetryConfig) (*LB, *Node, *Node, *int64) {
+	var hits int64
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	t.Cleanup(up.Close)
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	downNode, err := newNode(ServerConfig{URL: down.URL, Weight: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upNode, err := newNode(ServerConfig{URL: up.URL, Weight: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lb := &LB{Nodes: []*Node{downNode, upNode}, strategy: firstNodeStrategy{}}
+	WithRetry(cfg)(lb)
+	if err := lb.setupNodes(); err != nil {
+		t.Fatal(err)
+	}
+
+	return lb, downNode, upNode, &hits
+}
+
+func TestServeHTTPRetry(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	testCases := []struct {
+		name           string
+		cfg            RetryConfig
+		method         string
+		body           string
+		expectedStatus int
+		expectedBody   string
+		expectedHits   int64
+	}{
+		{
+			name:           "get is retried",
+			method:         http.MethodGet,
+			expectedStatus: http.StatusOK,
+			expectedHits:   1,
+		},
+		{
+			name:           "allowed method is retried with its body",
+			cfg:            RetryConfig{Methods: []string{http.MethodPut}},
+			method:         http.MethodPut,
+			body:           "payload",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "payload",
+			expectedHits:   1,
+		},
+		{
+			name:           "post is not retried",
+			method:         http.MethodPost,
+			body:           "payload",
+			expectedStatus: http.StatusBadGateway,
+		},
+		{
+			name:           "body bigger than the buffer is not retried",
+			cfg:            RetryConfig{MaxBodySize: 4, Methods: []string{http.MethodPut}},
+			method:         http.MethodPut,
+			body:           "payload",
+			expectedStatus: http.StatusBadGateway,
+		},
+		{
+			name:           "single attempt",
+			cfg:            RetryConfig{MaxAttempts: 1},
+			method:         http.MethodGet,
+			expectedStatus: http.StatusBadGateway,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			lb, downNode, upNode, hits := newRetryTestLB(t, tc.cfg)
+
+			r := httptest.NewRequest(tc.method, "/", strings.NewReader(tc.body))
+			w := httptest.NewRecorder()
+			lb.ServeHTTP(w, r)
+
+			g.Expect(w.Code).To(gomega.Equal(tc.expectedStatus))
+			g.Expect(w.Body.String()).To(gomega.Equal(tc.expectedBody))
+			g.Expect(atomic.LoadInt64(hits)).To(gomega.Equal(tc.expectedHits))
+			g.Expect(downNode.IsAlive()).To(gomega.BeFalse())
+
+			if tc.expectedStatus == http.StatusOK {
+				cookies := w.Result().Cookies()
+				g.Expect(cookies).To(gomega.HaveLen(1))
+				s, ok := lb.readSession(cookies[0].Value, time.Now())
+				g.Expect(ok).To(gomega.BeTrue())
+				g.Expect(s.nodeID).To(gomega.Equal(lb.cookieSigner().nodeID(upNode.URL)))
+			}
+		})
+	}
+}
+
+func TestServeHTTPRetryPerTryTimeout(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer slow.Close()
+
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fast"))
+	}))
+	defer fast.Close()
+
+	slowNode, err := newNode(ServerConfig{URL: slow.URL, Weight: 1})
+	g.Expect(err).To(gomega.BeNil())
+	fastNode, err := newNode(ServerConfig{URL: fast.URL, Weight: 1})
+	g.Expect(err).To(gomega.BeNil())
+
+	lb := &LB{Nodes: []*Node{slowNode, fastNode}, strategy: firstNodeStrategy{}}
+	WithRetry(RetryConfig{PerTryTimeout: Duration(50 * time.Millisecond)})(lb)
+	WithCircuitBreaker(CircuitBreakerConfig{FailureThreshold: 1})(lb)
+	g.Expect(lb.setupNodes()).To(gomega.BeNil())
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, r)
+
+	g.Expect(w.Code).To(gomega.Equal(http.StatusOK))
+	g.Expect(w.Body.String()).To(gomega.Equal("fast"))
+
+	// the slow node is still up, only its circuit breaker counts the timeout
+	g.Expect(slowNode.IsAlive()).To(gomega.BeTrue())
+	g.Expect(slowNode.Available()).To(gomega.BeFalse())
+}
+
+func TestServeHTTPRetryNoOtherNode(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	lb, downNode, _, _ := newRetryTestLB(t, RetryConfig{})
+	lb.Nodes = []*Node{downNode}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, r)
+
+	g.Expect(w.Code).To(gomega.Equal(http.StatusBadGateway))
+}
+
+func TestServeHTTPRetryKeepsHashRing(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	lb, downNode, upNode, hits := newRetryTestLB(t, RetryConfig{})
+	ch := NewConsistentHash(HashByHeader("X-User"), 0)
+	lb.strategy = ch
+
+	// find a key hashed to the node that can't be reached
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for i := 0; ; i++ {
+		r.Header.Set("X-User", fmt.Sprintf("user-%d", i))
+		node, err := ch.Select(lb.nodes(), r)
+		g.Expect(err).To(gomega.BeNil())
+		if node == downNode {
+			break
+		}
+	}
+	ring := ch.ring
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, r)
+
+	g.Expect(w.Code).To(gomega.Equal(http.StatusOK))
+	g.Expect(atomic.LoadInt64(hits)).To(gomega.Equal(int64(1)))
+	g.Expect(downNode.IsAlive()).To(gomega.BeFalse())
+
+	// the retry skipped the tried node without rebuilding the ring
+	g.Expect(ch.ring).To(gomega.BeIdenticalTo(ring))
+
+	node, err := lb.selectRetryNode(r, map[*Node]bool{downNode: true})
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(node).To(gomega.BeIdenticalTo(upNode))
+	g.Expect(ch.ring).To(gomega.BeIdenticalTo(ring))
+}
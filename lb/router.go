@@ -0,0 +1,293 @@
+package lb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RouterConfig is the configuration of a router serving several pools from one listener.
+// Hosts maps the Host header of the requests to the name of a pool, either exactly or with a
+// leading wildcard such as "*.example.com", which matches every subdomain of example.com but
+// not example.com itself. Requests whose host matches no pattern go to the Default pool, or
+// get a 404 without one. Each pool has its own servers and settings, e.g.
+//
+//	{
+//	  "hosts": {"shop.example.com": "shop", "*.api.example.com": "api"},
+//	  "default": "shop",
+//	  "pools": {
+//	    "shop": {"servers": ["http://localhost:8081"], "affinity": {"keys": ["secret"]}},
+//	    "api": {"servers": ["http://localhost:9001"], "strategy": {"name": "least_connections"}}
+//	  }
+//	}
+type RouterConfig struct {
+	Hosts   map[string]string  `json:"hosts,omitempty"`
+	Default string             `json:"default,omitempty"`
+	Pools   map[string]*Config `json:"pools"`
+}
+
+// IsRouterConfig reports whether the JSON configuration describes several pools rather
+// than a single one.
+func IsRouterConfig(data []byte) bool {
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return false
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return false
+	}
+
+	_, ok := fields["pools"]
+	return ok
+}
+
+// ParseRouterConfig decodes and validates a JSON router configuration.
+func ParseRouterConfig(data []byte) (*RouterConfig, error) {
+	cfg := &RouterConfig{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// validate checks that every pool is valid and that the hosts and the default pool refer
+// to existing pools. Host patterns are lowercased.
+func (cfg *RouterConfig) validate() error {
+	if len(cfg.Pools) == 0 {
+		return errors.New("at least one pool is required")
+	}
+
+	for name, pool := range cfg.Pools {
+		if pool == nil || len(pool.Servers) == 0 {
+			return fmt.Errorf("pool '%s' requires at least one server", name)
+		}
+
+		if _, err := pool.Options(); err != nil {
+			return fmt.Errorf("invalid pool '%s': %w", name, err)
+		}
+	}
+
+	if len(cfg.Hosts) == 0 && cfg.Default == "" {
+		return errors.New("at least one host or a default pool is required")
+	}
+
+	hosts := make(map[string]string, len(cfg.Hosts))
+	for pattern, name := range cfg.Hosts {
+		host := strings.ToLower(pattern)
+		if err := validateHostPattern(host); err != nil {
+			return err
+		}
+
+		if _, ok := hosts[host]; ok {
+			return fmt.Errorf("duplicate host '%s'", pattern)
+		}
+
+		if _, ok := cfg.Pools[name]; !ok {
+			return fmt.Errorf("host '%s' refers to unknown pool '%s'", pattern, name)
+		}
+		hosts[host] = name
+	}
+	cfg.Hosts = hosts
+
+	if _, ok := cfg.Pools[cfg.Default]; cfg.Default != "" && !ok {
+		return fmt.Errorf("unknown default pool '%s'", cfg.Default)
+	}
+
+	return nil
+}
+
+// validateHostPattern checks a host pattern, the wildcard being only allowed as the first label.
+func validateHostPattern(pattern string) error {
+	host := strings.TrimPrefix(pattern, "*.")
+	if host == "" || strings.Contains(host, "*") || strings.Contains(host, ":") || strings.HasPrefix(host, ".") {
+		return fmt.Errorf("invalid host '%s'", pattern)
+	}
+
+	return nil
+}
+
+// Router is an http.Handler sending every request to the pool serving its Host header.
+type Router struct {
+	pools     map[string]*LB
+	exact     map[string]*LB
+	wildcards []wildcardRoute
+	fallback  *LB
+	done      chan struct{}
+	stopOnce  sync.Once
+}
+
+// wildcardRoute routes the subdomains of a domain, suffix being the domain with a leading dot.
+type wildcardRoute struct {
+	suffix string
+	pool   *LB
+}
+
+// NewRouter creates a router and a load balancer for each pool of the configuration. Like
+// the ones created by New, the pools run until ctx is cancelled or Close is called.
+func NewRouter(ctx context.Context, cfg *RouterConfig) (*Router, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	rt := &Router{
+		pools: make(map[string]*LB, len(cfg.Pools)),
+		exact: map[string]*LB{},
+		done:  make(chan struct{}),
+	}
+
+	for name, pool := range cfg.Pools {
+		opts, err := pool.Options()
+		if err != nil {
+			rt.Close()
+			return nil, err
+		}
+
+		lb, err := New(ctx, pool.Servers, opts...)
+		if err != nil {
+			rt.Close()
+			return nil, fmt.Errorf("invalid pool '%s': %w", name, err)
+		}
+		rt.pools[name] = lb
+	}
+
+	for pattern, name := range cfg.Hosts {
+		if strings.HasPrefix(pattern, "*.") {
+			rt.wildcards = append(rt.wildcards, wildcardRoute{suffix: pattern[1:], pool: rt.pools[name]})
+			continue
+		}
+		rt.exact[pattern] = rt.pools[name]
+	}
+
+	// the most specific wildcard wins
+	sort.Slice(rt.wildcards, func(i, j int) bool {
+		return len(rt.wildcards[i].suffix) > len(rt.wildcards[j].suffix)
+	})
+
+	rt.fallback = rt.pools[cfg.Default]
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			rt.stop()
+		case <-rt.done:
+		}
+	}()
+
+	return rt, nil
+}
+
+// ServeHTTP proxies the request through the pool serving its host.
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	pool := rt.route(r.Host)
+	if pool == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	pool.ServeHTTP(w, r)
+}
+
+// route returns the pool serving the host, which may include a port, or nil if there is none.
+func (rt *Router) route(host string) *LB {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	if pool, ok := rt.exact[host]; ok {
+		return pool
+	}
+
+	for _, route := range rt.wildcards {
+		if strings.HasSuffix(host, route.suffix) && len(host) > len(route.suffix) {
+			return route.pool
+		}
+	}
+
+	return rt.fallback
+}
+
+// Pool returns the load balancer of the named pool, or nil if there is none.
+func (rt *Router) Pool(name string) *LB {
+	return rt.pools[name]
+}
+
+// Reload updates the servers of every pool like LB.Reload. Adding or removing pools is an
+// error, while the hosts and the other settings of the pools are kept as they are until
+// a restart. Nothing is changed when one of the pools is invalid.
+func (rt *Router) Reload(cfg *RouterConfig) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	if len(cfg.Pools) != len(rt.pools) {
+		return errors.New("adding or removing pools requires a restart")
+	}
+
+	for name, pool := range cfg.Pools {
+		lb, ok := rt.pools[name]
+		if !ok {
+			return errors.New("adding or removing pools requires a restart")
+		}
+
+		if _, _, err := lb.prepareNodes(pool.Servers); err != nil {
+			return fmt.Errorf("invalid pool '%s': %w", name, err)
+		}
+	}
+
+	for name, pool := range cfg.Pools {
+		if err := rt.pools[name].Reload(pool.Servers); err != nil {
+			return fmt.Errorf("invalid pool '%s': %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// reloadConfig reloads the servers of a configuration file of the router.
+func (rt *Router) reloadConfig(data []byte) error {
+	cfg, err := ParseRouterConfig(data)
+	if err != nil {
+		return err
+	}
+
+	return rt.Reload(cfg)
+}
+
+// NewRouterConfigWatcher creates a watcher of the configuration file of the router at path,
+// reloading the servers of its pools like NewConfigWatcher.
+func NewRouterConfigWatcher(rt *Router, path string, interval time.Duration) *ConfigWatcher {
+	return newConfigWatcher(rt.reloadConfig, rt.done, path, interval)
+}
+
+// Close stops every pool and waits for their background work to be over.
+func (rt *Router) Close() error {
+	rt.stop()
+
+	for _, lb := range rt.pools {
+		lb.Close()
+	}
+
+	return nil
+}
+
+// stop closes the done channel of the router once.
+func (rt *Router) stop() {
+	rt.stopOnce.Do(func() {
+		close(rt.done)
+	})
+}
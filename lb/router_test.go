@@ -0,0 +1,297 @@
+package lb
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bsm/gomega"
+)
+
+func newRouterTestConfig(pools map[string][]string, hosts map[string]string, defaultPool string) *RouterConfig {
+	cfg := &RouterConfig{Hosts: hosts, Default: defaultPool, Pools: map[string]*Config{}}
+	for name, urls := range pools {
+		cfg.Pools[name] = &Config{Servers: serverConfigs(urls)}
+	}
+	return cfg
+}
+
+func TestIsRouterConfig(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	g.Expect(IsRouterConfig([]byte(`{"pools": {"shop": ["http://localhost:8081"]}, "default": "shop"}`))).To(gomega.BeTrue())
+	g.Expect(IsRouterConfig([]byte(`{"servers": ["http://localhost:8081"]}`))).To(gomega.BeFalse())
+	g.Expect(IsRouterConfig([]byte(`["http://localhost:8081"]`))).To(gomega.BeFalse())
+	g.Expect(IsRouterConfig([]byte(`{"pools": `))).To(gomega.BeFalse())
+}
+
+func TestParseRouterConfig(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	testCases := []struct {
+		name        string
+		data        string
+		expectedErr bool
+	}{
+		{
+			name: "valid",
+			data: `{
+				"hosts": {"Shop.Example.com": "shop", "*.api.example.com": "api"},
+				"default": "shop",
+				"pools": {
+					"shop": {"servers": ["http://localhost:8081"], "affinity": {"keys": ["secret"]}},
+					"api": ["http://localhost:9001"]
+				}
+			}`,
+		},
+		{
+			name:        "no pool",
+			data:        `{"pools": {}, "default": "shop"}`,
+			expectedErr: true,
+		},
+		{
+			name:        "pool without servers",
+			data:        `{"pools": {"shop": {"servers": []}}, "default": "shop"}`,
+			expectedErr: true,
+		},
+		{
+			name:        "invalid pool settings",
+			data:        `{"pools": {"shop": {"servers": ["http://localhost:8081"], "strategy": {"name": "fastest"}}}, "default": "shop"}`,
+			expectedErr: true,
+		},
+		{
+			name:        "no host nor default",
+			data:        `{"pools": {"shop": ["http://localhost:8081"]}}`,
+			expectedErr: true,
+		},
+		{
+			name:        "unknown pool",
+			data:        `{"hosts": {"shop.example.com": "store"}, "pools": {"shop": ["http://localhost:8081"]}}`,
+			expectedErr: true,
+		},
+		{
+			name:        "unknown default pool",
+			data:        `{"default": "store", "pools": {"shop": ["http://localhost:8081"]}}`,
+			expectedErr: true,
+		},
+		{
+			name:        "wildcard in the middle",
+			data:        `{"hosts": {"shop.*.com": "shop"}, "pools": {"shop": ["http://localhost:8081"]}}`,
+			expectedErr: true,
+		},
+		{
+			name:        "host with port",
+			data:        `{"hosts": {"shop.example.com:8000": "shop"}, "pools": {"shop": ["http://localhost:8081"]}}`,
+			expectedErr: true,
+		},
+		{
+			name:        "duplicate host",
+			data:        `{"hosts": {"shop.example.com": "shop", "SHOP.example.com": "shop"}, "pools": {"shop": ["http://localhost:8081"]}}`,
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := ParseRouterConfig([]byte(tc.data))
+			if tc.expectedErr {
+				g.Expect(err).NotTo(gomega.BeNil())
+				return
+			}
+
+			g.Expect(err).To(gomega.BeNil())
+			g.Expect(cfg.Hosts).To(gomega.Equal(map[string]string{"shop.example.com": "shop", "*.api.example.com": "api"}))
+			g.Expect(cfg.Pools["shop"].Affinity.Keys).To(gomega.Equal([]string{"secret"}))
+			g.Expect(cfg.Pools["api"].Servers).To(gomega.Equal(serverConfigs([]string{"http://localhost:9001"})))
+		})
+	}
+}
+
+func TestRouterRoute(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	rt, err := NewRouter(context.Background(), newRouterTestConfig(
+		map[string][]string{
+			"shop":  {"http://localhost:8081"},
+			"api":   {"http://localhost:8082"},
+			"admin": {"http://localhost:8083"},
+			"other": {"http://localhost:8084"},
+		},
+		map[string]string{
+			"shop.example.com":        "shop",
+			"*.example.com":           "api",
+			"*.admin.example.com":     "admin",
+			"exact.admin.example.com": "shop",
+		},
+		"other",
+	))
+	g.Expect(err).To(gomega.BeNil())
+	defer rt.Close()
+
+	testCases := []struct {
+		host         string
+		expectedPool string
+	}{
+		{host: "shop.example.com", expectedPool: "shop"},
+		{host: "shop.example.com:8000", expectedPool: "shop"},
+		{host: "SHOP.Example.com.", expectedPool: "shop"},
+		{host: "v1.example.com", expectedPool: "api"},
+		{host: "a.b.example.com", expectedPool: "api"},
+		{host: "eu.admin.example.com", expectedPool: "admin"},
+		{host: "exact.admin.example.com", expectedPool: "shop"},
+		{host: "example.com", expectedPool: "other"},
+		{host: "notexample.com", expectedPool: "other"},
+		{host: "[::1]:8000", expectedPool: "other"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.host, func(t *testing.T) {
+			g.Expect(rt.route(tc.host)).To(gomega.BeIdenticalTo(rt.Pool(tc.expectedPool)))
+		})
+	}
+}
+
+func TestRouterServeHTTP(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	shop := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("shop"))
+	}))
+	defer shop.Close()
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("api"))
+	}))
+	defer api.Close()
+
+	cfg := newRouterTestConfig(
+		map[string][]string{"shop": {shop.URL}, "api": {api.URL}},
+		map[string]string{"shop.example.com": "shop", "*.api.example.com": "api"},
+		"",
+	)
+	cfg.Pools["shop"].Affinity = &AffinityConfig{Cookie: CookieConfig{Name: "shop_session"}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rt, err := NewRouter(ctx, cfg)
+	g.Expect(err).To(gomega.BeNil())
+
+	testCases := []struct {
+		host           string
+		expectedStatus int
+		expectedBody   string
+		expectedCookie string
+	}{
+		{host: "shop.example.com", expectedStatus: http.StatusOK, expectedBody: "shop", expectedCookie: "shop_session"},
+		{host: "v2.api.example.com", expectedStatus: http.StatusOK, expectedBody: "api", expectedCookie: "session"},
+		{host: "unknown.example.com", expectedStatus: http.StatusNotFound, expectedBody: "Not Found\n"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.host, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Host = tc.host
+			w := httptest.NewRecorder()
+			rt.ServeHTTP(w, r)
+
+			g.Expect(w.Code).To(gomega.Equal(tc.expectedStatus))
+			g.Expect(w.Body.String()).To(gomega.Equal(tc.expectedBody))
+
+			cookies := w.Result().Cookies()
+			if tc.expectedCookie == "" {
+				g.Expect(cookies).To(gomega.BeEmpty())
+			} else {
+				g.Expect(cookies).To(gomega.HaveLen(1))
+				g.Expect(cookies[0].Name).To(gomega.Equal(tc.expectedCookie))
+			}
+		})
+	}
+
+	// cancelling the context stops every pool
+	cancel()
+	g.Eventually(rt.done).Should(gomega.BeClosed())
+	g.Eventually(rt.Pool("shop").stopped()).Should(gomega.BeClosed())
+	g.Eventually(rt.Pool("api").stopped()).Should(gomega.BeClosed())
+	g.Expect(rt.Close()).To(gomega.Succeed())
+}
+
+func TestRouterReload(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	rt, err := NewRouter(context.Background(), newRouterTestConfig(
+		map[string][]string{"shop": {"http://localhost:8081"}, "api": {"http://localhost:8082"}},
+		map[string]string{"shop.example.com": "shop"},
+		"api",
+	))
+	g.Expect(err).To(gomega.BeNil())
+	defer rt.Close()
+
+	testCases := []struct {
+		name  string
+		pools map[string][]string
+	}{
+		{
+			name:  "pool added",
+			pools: map[string][]string{"shop": {"http://localhost:8081"}, "api": {"http://localhost:8082"}, "blog": {"http://localhost:8083"}},
+		},
+		{
+			name:  "pool renamed",
+			pools: map[string][]string{"shop": {"http://localhost:8081"}, "blog": {"http://localhost:8082"}},
+		},
+		{
+			name:  "invalid server in one pool",
+			pools: map[string][]string{"shop": {"http://localhost:8081", "http://localhost:8085"}, "api": {"http://local host"}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			g.Expect(rt.Reload(newRouterTestConfig(tc.pools, nil, "shop"))).NotTo(gomega.Succeed())
+			g.Expect(nodeURLs(rt.Pool("shop").nodes())).To(gomega.Equal([]string{"http://localhost:8081"}))
+			g.Expect(nodeURLs(rt.Pool("api").nodes())).To(gomega.Equal([]string{"http://localhost:8082"}))
+		})
+	}
+
+	g.Expect(rt.Reload(newRouterTestConfig(
+		map[string][]string{"shop": {"http://localhost:8081", "http://localhost:8085"}, "api": {"http://localhost:8082"}},
+		nil,
+		"shop",
+	))).To(gomega.Succeed())
+	g.Expect(nodeURLs(rt.Pool("shop").nodes())).To(gomega.Equal([]string{"http://localhost:8081", "http://localhost:8085"}))
+	g.Expect(nodeURLs(rt.Pool("api").nodes())).To(gomega.Equal([]string{"http://localhost:8082"}))
+}
+
+func TestRouterConfigWatcher(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	cfg := newRouterTestConfig(map[string][]string{"shop": {"http://localhost:8081"}}, nil, "shop")
+	data, err := json.Marshal(cfg)
+	g.Expect(err).To(gomega.BeNil())
+
+	path := filepath.Join(t.TempDir(), "serverlist.json")
+	g.Expect(os.WriteFile(path, data, 0o644)).To(gomega.Succeed())
+
+	rt, err := NewRouter(context.Background(), cfg)
+	g.Expect(err).To(gomega.BeNil())
+	cw := NewRouterConfigWatcher(rt, path, time.Hour)
+
+	g.Expect(os.WriteFile(path, []byte(`{"default": "shop", "pools": {"shop": ["http://localhost:8081", "http://localhost:8082"]}}`), 0o644)).To(gomega.Succeed())
+	g.Expect(cw.load(false)).To(gomega.Succeed())
+	g.Expect(nodeURLs(rt.Pool("shop").Nodes)).To(gomega.Equal([]string{"http://localhost:8081", "http://localhost:8082"}))
+
+	g.Expect(os.WriteFile(path, []byte(`["http://localhost:8081"]`), 0o644)).To(gomega.Succeed())
+	g.Expect(cw.load(false)).NotTo(gomega.Succeed())
+
+	// the watcher stops with the router
+	stopped := make(chan struct{})
+	go func() {
+		cw.Run()
+		close(stopped)
+	}()
+	g.Expect(rt.Close()).To(gomega.Succeed())
+	g.Eventually(stopped).Should(gomega.BeClosed())
+}
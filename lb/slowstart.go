@@ -0,0 +1,52 @@
+package lb
+
+import (
+	"errors"
+	"time"
+)
+
+// Default slow start settings.
+const (
+	defaultSlowStartWindow         = 30 * time.Second
+	defaultSlowStartMinWeightRatio = 0.1
+)
+
+// SlowStartConfig configures the slow start of the nodes of a pool. When a node is marked
+// alive again by the health check, its weight ramps up linearly from MinWeightRatio of its
+// weight to its full weight over Window, so it isn't hit by its full share of traffic while
+// still warming up.
+// Zero values fall back to 30 seconds starting from 10% of the weight.
+type SlowStartConfig struct {
+	Window         Duration `json:"window,omitempty"`
+	MinWeightRatio float64  `json:"min_weight_ratio,omitempty"`
+}
+
+// validate checks the configuration and fills in the default values.
+func (cfg *SlowStartConfig) validate() error {
+	if cfg.Window < 0 {
+		return errors.New("slow start window can't be negative")
+	}
+
+	if cfg.MinWeightRatio < 0 || cfg.MinWeightRatio > 1 {
+		return errors.New("slow start min weight ratio must be between 0 and 1")
+	}
+
+	if cfg.Window == 0 {
+		cfg.Window = Duration(defaultSlowStartWindow)
+	}
+
+	if cfg.MinWeightRatio == 0 {
+		cfg.MinWeightRatio = defaultSlowStartMinWeightRatio
+	}
+
+	return nil
+}
+
+// ratio returns the share of its weight a node gets elapsed after coming back.
+func (cfg *SlowStartConfig) ratio(elapsed time.Duration) float64 {
+	if elapsed < 0 || elapsed >= time.Duration(cfg.Window) {
+		return 1
+	}
+	progress := float64(elapsed) / float64(cfg.Window)
+	return cfg.MinWeightRatio + (1-cfg.MinWeightRatio)*progress
+}
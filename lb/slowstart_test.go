@@ -0,0 +1,94 @@
+package lb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bsm/gomega"
+)
+
+func TestSlowStartConfigValidate(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	testCases := []struct {
+		name        string
+		cfg         SlowStartConfig
+		expectedCfg SlowStartConfig
+		expectedErr bool
+	}{
+		{
+			name:        "defaults",
+			cfg:         SlowStartConfig{},
+			expectedCfg: SlowStartConfig{Window: Duration(30 * time.Second), MinWeightRatio: 0.1},
+		},
+		{
+			name:        "custom",
+			cfg:         SlowStartConfig{Window: Duration(time.Minute), MinWeightRatio: 0.5},
+			expectedCfg: SlowStartConfig{Window: Duration(time.Minute), MinWeightRatio: 0.5},
+		},
+		{
+			name:        "negative window",
+			cfg:         SlowStartConfig{Window: Duration(-time.Second)},
+			expectedErr: true,
+		},
+		{
+			name:        "min weight ratio above 1",
+			cfg:         SlowStartConfig{MinWeightRatio: 1.5},
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := tc.cfg
+			err := cfg.validate()
+
+			if tc.expectedErr {
+				g.Expect(err).NotTo(gomega.BeNil())
+			} else {
+				g.Expect(err).To(gomega.BeNil())
+				g.Expect(cfg).To(gomega.Equal(tc.expectedCfg))
+			}
+		})
+	}
+}
+
+func TestSlowStartRatio(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	cfg := SlowStartConfig{Window: Duration(10 * time.Second), MinWeightRatio: 0.2}
+
+	g.Expect(cfg.ratio(0)).To(gomega.BeNumerically("~", 0.2))
+	g.Expect(cfg.ratio(5 * time.Second)).To(gomega.BeNumerically("~", 0.6))
+	g.Expect(cfg.ratio(10 * time.Second)).To(gomega.BeNumerically("~", 1))
+	g.Expect(cfg.ratio(time.Minute)).To(gomega.BeNumerically("~", 1))
+}
+
+func TestSlowStartWeight(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	cfg := SlowStartConfig{Window: Duration(10 * time.Second), MinWeightRatio: 0.1}
+	g.Expect(cfg.validate()).To(gomega.BeNil())
+
+	node, err := newNode(ServerConfig{URL: "http://localhost:8081", Weight: 10})
+	g.Expect(err).To(gomega.BeNil())
+	node.slowStart = &cfg
+
+	// nodes alive from the start get their full weight
+	g.Expect(node.Weight()).To(gomega.Equal(10.0))
+
+	node.recordCheck(false)
+	g.Expect(node.IsAlive()).To(gomega.BeFalse())
+	node.recordCheck(true)
+	g.Expect(node.IsAlive()).To(gomega.BeTrue())
+
+	// a node coming back starts from a fraction of its weight
+	g.Expect(node.Weight()).To(gomega.BeNumerically("~", 1, 0.1))
+
+	node.recoveredAt = time.Now().Add(-5 * time.Second)
+	g.Expect(node.Weight()).To(gomega.BeNumerically("~", 5.5, 0.1))
+
+	node.recoveredAt = time.Now().Add(-10 * time.Second)
+	g.Expect(node.Weight()).To(gomega.Equal(10.0))
+	g.Expect(node.BaseWeight()).To(gomega.Equal(10.0))
+}
@@ -0,0 +1,105 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// ErrNoAvailableNode is returned when none of the nodes is able to serve a request.
+var ErrNoAvailableNode = errors.New("no available node")
+
+// Strategy decides which node should serve an incoming request.
+// Select receives every node of the pool sorted by weight in descending order and
+// must skip the nodes that are not able to take traffic, see Node.Available. When a request
+// is retried, the built-in strategies also skip the nodes it already tried, and other
+// strategies are given the nodes not tried yet if they pick a tried one. It is called for every request,
+// possibly concurrently, so it should rely on the status kept by the health checks rather
+// than contacting the nodes itself.
+type Strategy interface {
+	Select(nodes []*Node, r *http.Request) (*Node, error)
+}
+
+// StrategyConfig selects the built-in strategy of a pool by Name, one of
+// "weighted_round_robin" (the default), "round_robin", "least_connections",
+// "power_of_two_choices" and "consistent_hash". The consistent hash strategy hashes requests
+// by HashKey, either "client_ip" (the default), "path", "header:<name>" or "query:<param>",
+// placing Replicas virtual nodes per node on the ring.
+type StrategyConfig struct {
+	Name     string `json:"name"`
+	HashKey  string `json:"hash_key,omitempty"`
+	Replicas int    `json:"replicas,omitempty"`
+}
+
+// newStrategy creates the strategy described by the configuration.
+func (cfg StrategyConfig) newStrategy() (Strategy, error) {
+	switch cfg.Name {
+	case "", "weighted_round_robin":
+		return NewWeightedRoundRobin(), nil
+	case "round_robin":
+		return NewRoundRobin(), nil
+	case "least_connections":
+		return NewLeastConnections(), nil
+	case "power_of_two_choices":
+		return NewPowerOfTwoChoices(), nil
+	case "consistent_hash":
+		key, err := parseHashKey(cfg.HashKey)
+		if err != nil {
+			return nil, err
+		}
+		return NewConsistentHash(key, cfg.Replicas), nil
+	}
+
+	return nil, fmt.Errorf("unknown strategy '%s'", cfg.Name)
+}
+
+// parseHashKey returns the hash key function described by key.
+func parseHashKey(key string) (HashKeyFunc, error) {
+	kind, name, _ := strings.Cut(key, ":")
+	switch {
+	case key == "" || key == "client_ip":
+		return HashByClientIP(), nil
+	case key == "path":
+		return HashByPath(), nil
+	case kind == "header" && name != "":
+		return HashByHeader(name), nil
+	case kind == "query" && name != "":
+		return HashByQuery(name), nil
+	}
+
+	return nil, fmt.Errorf("invalid hash key '%s'", key)
+}
+
+// selectable reports whether the node can serve the request: it is available and the
+// request wasn't excluded from it.
+func selectable(node *Node, r *http.Request) bool {
+	return node.Available() && !isExcluded(r, node)
+}
+
+// RoundRobin is a Strategy that walks the weight-sorted nodes in circular order,
+// skipping the nodes that are down.
+type RoundRobin struct {
+	current int64
+}
+
+// NewRoundRobin creates a new round robin strategy starting at the first node.
+func NewRoundRobin() *RoundRobin {
+	return &RoundRobin{}
+}
+
+// Select returns the next available node.
+func (rr *RoundRobin) Select(nodes []*Node, r *http.Request) (*Node, error) {
+	for i := 0; i < len(nodes); i++ {
+		// claim the current index and move the cursor forward in one atomic step
+		// so that concurrent requests never pick the same slot twice
+		index := (atomic.AddInt64(&rr.current, 1) - 1) % int64(len(nodes))
+		node := nodes[index]
+		if selectable(node, r) {
+			return node, nil
+		}
+	}
+
+	return nil, ErrNoAvailableNode
+}
@@ -0,0 +1,116 @@
+package lb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/bsm/gomega"
+)
+
+func TestRoundRobinSelect(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	activeNode1 := &Node{URL: &url.URL{Host: "active1.com"}, alive: true}
+	activeNode2 := &Node{URL: &url.URL{Host: "active2.com"}, alive: true}
+	inactiveNode := &Node{URL: &url.URL{Host: "inactive.com"}, alive: false}
+
+	rr := NewRoundRobin()
+	nodes := []*Node{activeNode1, inactiveNode, activeNode2}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	// the node that is down is skipped
+	expectedNodes := []*Node{activeNode1, activeNode2, activeNode1, activeNode2}
+	for _, expectedNode := range expectedNodes {
+		node, err := rr.Select(nodes, r)
+
+		g.Expect(err).To(gomega.BeNil())
+		g.Expect(node).To(gomega.BeIdenticalTo(expectedNode))
+	}
+
+	node, err := rr.Select([]*Node{inactiveNode}, r)
+	g.Expect(node).To(gomega.BeNil())
+	g.Expect(err).To(gomega.Equal(ErrNoAvailableNode))
+}
+
+func TestStrategyConfigNewStrategy(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/users/42?tenant=acme", nil)
+	r.Header.Set("X-User", "alice")
+
+	testCases := []struct {
+		name        string
+		cfg         StrategyConfig
+		expected    Strategy
+		expectedKey string
+		expectedErr bool
+	}{
+		{
+			name:     "default",
+			cfg:      StrategyConfig{},
+			expected: NewWeightedRoundRobin(),
+		},
+		{
+			name:     "round robin",
+			cfg:      StrategyConfig{Name: "round_robin"},
+			expected: NewRoundRobin(),
+		},
+		{
+			name:     "least connections",
+			cfg:      StrategyConfig{Name: "least_connections"},
+			expected: NewLeastConnections(),
+		},
+		{
+			name:     "power of two choices",
+			cfg:      StrategyConfig{Name: "power_of_two_choices"},
+			expected: NewPowerOfTwoChoices(),
+		},
+		{
+			name:        "consistent hash by header",
+			cfg:         StrategyConfig{Name: "consistent_hash", HashKey: "header:X-User", Replicas: 10},
+			expectedKey: "alice",
+		},
+		{
+			name:        "consistent hash by query",
+			cfg:         StrategyConfig{Name: "consistent_hash", HashKey: "query:tenant"},
+			expectedKey: "acme",
+		},
+		{
+			name:        "consistent hash by path",
+			cfg:         StrategyConfig{Name: "consistent_hash", HashKey: "path"},
+			expectedKey: "/users/42",
+		},
+		{
+			name:        "invalid hash key",
+			cfg:         StrategyConfig{Name: "consistent_hash", HashKey: "header:"},
+			expectedErr: true,
+		},
+		{
+			name:        "unknown strategy",
+			cfg:         StrategyConfig{Name: "fastest"},
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			strategy, err := tc.cfg.newStrategy()
+			if tc.expectedErr {
+				g.Expect(err).NotTo(gomega.BeNil())
+				return
+			}
+			g.Expect(err).To(gomega.BeNil())
+
+			if tc.expectedKey == "" {
+				g.Expect(strategy).To(gomega.BeAssignableToTypeOf(tc.expected))
+				return
+			}
+
+			ch, ok := strategy.(*ConsistentHash)
+			g.Expect(ok).To(gomega.BeTrue())
+			g.Expect(ch.key(r)).To(gomega.Equal(tc.expectedKey))
+		})
+	}
+}
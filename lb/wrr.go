@@ -0,0 +1,102 @@
+package lb
+
+import (
+	"net/http"
+	"sync"
+)
+
+// WeightedRoundRobin is a Strategy implementing the smooth weighted round robin used by nginx.
+// Every node accumulates its weight on each selection and the node with the highest
+// accumulated weight is picked and lowered by the total weight, so over time each node
+// receives a share of the traffic proportional to its weight, spread evenly instead of in bursts.
+// Nodes that are down are skipped.
+type WeightedRoundRobin struct {
+	mux        sync.Mutex
+	current    map[*Node]*wrrWeight
+	selections uint64
+}
+
+// wrrWeight is the current weight of a node, and the selection it was last part of the nodes.
+type wrrWeight struct {
+	value float64
+	seen  uint64
+}
+
+// wrrPruneInterval is the number of selections after which the nodes that weren't part of
+// any of them are forgotten.
+const wrrPruneInterval = 1000
+
+// NewWeightedRoundRobin creates a new smooth weighted round robin strategy.
+func NewWeightedRoundRobin() *WeightedRoundRobin {
+	return &WeightedRoundRobin{
+		current: map[*Node]*wrrWeight{},
+	}
+}
+
+// Select returns the available node with the highest current weight.
+func (wrr *WeightedRoundRobin) Select(nodes []*Node, r *http.Request) (*Node, error) {
+	candidates := make([]*Node, 0, len(nodes))
+	for _, node := range nodes {
+		if selectable(node, r) {
+			candidates = append(candidates, node)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil, ErrNoAvailableNode
+	}
+
+	return wrr.next(nodes, candidates), nil
+}
+
+// next picks the candidate with the highest current weight after raising every
+// candidate by its weight, and lowers the picked one by the total weight.
+// Nodes that aren't candidates, such as the ones a retried request already tried, keep
+// their current weight, and are only forgotten once they left the pool.
+func (wrr *WeightedRoundRobin) next(nodes, candidates []*Node) *Node {
+	wrr.mux.Lock()
+	defer wrr.mux.Unlock()
+
+	if wrr.current == nil {
+		wrr.current = map[*Node]*wrrWeight{}
+	}
+
+	wrr.selections++
+	for _, node := range nodes {
+		if w, ok := wrr.current[node]; ok {
+			w.seen = wrr.selections
+		} else {
+			wrr.current[node] = &wrrWeight{seen: wrr.selections}
+		}
+	}
+
+	if wrr.selections%wrrPruneInterval == 0 {
+		wrr.prune()
+	}
+
+	var best *Node
+	var total float64
+	for _, node := range candidates {
+		weight := node.Weight()
+		wrr.current[node].value += weight
+		total += weight
+
+		if best == nil || wrr.current[node].value > wrr.current[best].value {
+			best = node
+		}
+	}
+
+	wrr.current[best].value -= total
+
+	return best
+}
+
+// prune forgets about the nodes that weren't part of any selection since the last pruning,
+// which are the nodes that left the pool.
+func (wrr *WeightedRoundRobin) prune() {
+	for node, w := range wrr.current {
+		if wrr.selections-w.seen >= wrrPruneInterval {
+			delete(wrr.current, node)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package lb
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/bsm/gomega"
+)
+
+func TestWeightedRoundRobinDistribution(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	testCases := []struct {
+		name     string
+		weights  []float64
+		requests int
+	}{
+		{
+			name:     "equal weights",
+			weights:  []float64{1, 1, 1},
+			requests: 300,
+		},
+		{
+			name:     "integer weights",
+			weights:  []float64{3, 2, 1},
+			requests: 600,
+		},
+		{
+			name:     "fractional weights",
+			weights:  []float64{1, 0.5},
+			requests: 300,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			nodes := []*Node{}
+			var totalWeight float64
+			for _, weight := range tc.weights {
+				nodes = append(nodes, &Node{URL: &url.URL{Host: "example.com"}, alive: true, weight: weight})
+				totalWeight += weight
+			}
+
+			wrr := NewWeightedRoundRobin()
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+			hits := map[*Node]int{}
+			for i := 0; i < tc.requests; i++ {
+				node, err := wrr.Select(nodes, r)
+				g.Expect(err).To(gomega.BeNil())
+				hits[node]++
+			}
+
+			for _, node := range nodes {
+				expectedHits := float64(tc.requests) * node.weight / totalWeight
+				g.Expect(float64(hits[node])).To(gomega.BeNumerically("~", expectedHits, 1))
+			}
+		})
+	}
+}
+
+func TestWeightedRoundRobinSmoothness(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	a := &Node{URL: &url.URL{Host: "a.com"}, alive: true, weight: 5}
+	b := &Node{URL: &url.URL{Host: "b.com"}, alive: true, weight: 1}
+	c := &Node{URL: &url.URL{Host: "c.com"}, alive: true, weight: 1}
+
+	wrr := NewWeightedRoundRobin()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	// the heavy node is interleaved with the others instead of being picked 5 times in a row
+	expectedNodes := []*Node{a, a, b, a, c, a, a, a, a, b, a, c, a, a}
+	for _, expectedNode := range expectedNodes {
+		node, err := wrr.Select([]*Node{a, b, c}, r)
+
+		g.Expect(err).To(gomega.BeNil())
+		g.Expect(node).To(gomega.BeIdenticalTo(expectedNode))
+	}
+}
+
+func TestWeightedRoundRobinSkipsDownNodes(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	activeNode := &Node{URL: &url.URL{Host: "active.com"}, alive: true, weight: 1}
+	downNode := &Node{URL: &url.URL{Host: "down.com"}, alive: false, weight: 5}
+
+	wrr := NewWeightedRoundRobin()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	for i := 0; i < 3; i++ {
+		node, err := wrr.Select([]*Node{downNode, activeNode}, r)
+
+		g.Expect(err).To(gomega.BeNil())
+		g.Expect(node).To(gomega.BeIdenticalTo(activeNode))
+	}
+
+	node, err := wrr.Select([]*Node{downNode}, r)
+	g.Expect(node).To(gomega.BeNil())
+	g.Expect(err).To(gomega.Equal(ErrNoAvailableNode))
+}
+
+func TestWeightedRoundRobinKeepsWeightsAcrossRetries(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	a := &Node{URL: &url.URL{Host: "a.com"}, alive: true, weight: 1}
+	b := &Node{URL: &url.URL{Host: "b.com"}, alive: true, weight: 1}
+	c := &Node{URL: &url.URL{Host: "c.com"}, alive: true, weight: 1}
+
+	wrr := NewWeightedRoundRobin()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	node, err := wrr.Select([]*Node{a, b, c}, r)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(node).To(gomega.BeIdenticalTo(a))
+	g.Expect(wrr.current[a].value).To(gomega.Equal(float64(-2)))
+
+	// a retry excluding the tried node leaves its weight alone
+	retry := r.WithContext(context.WithValue(r.Context(), excludedNodesKey{}, map[*Node]bool{a: true}))
+	node, err = wrr.Select([]*Node{a, b, c}, retry)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(node).To(gomega.BeIdenticalTo(b))
+	g.Expect(wrr.current[a].value).To(gomega.Equal(float64(-2)))
+
+	// a node that left the pool is eventually forgotten
+	for i := 0; i < 2*wrrPruneInterval; i++ {
+		wrr.Select([]*Node{b, c}, r)
+	}
+	g.Expect(wrr.current).NotTo(gomega.HaveKey(a))
+	g.Expect(wrr.current).To(gomega.HaveLen(2))
+}
@@ -1,33 +1,143 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"mylb/lb"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 )
 
-func main() {
-	data, err := ioutil.ReadFile("serverlist.json")
-	if err != nil {
-		panic(err)
-	}
+const configPath = "serverlist.json"
 
-	var originServerList []string
-	err = json.Unmarshal(data, &originServerList)
+func main() {
+	data, err := ioutil.ReadFile(configPath)
 	if err != nil {
 		panic(err)
 	}
 
 	portFlag := flag.Int("port", 8000, "listening port")
+	adminPortFlag := flag.Int("admin-port", 0, "listening port of the admin API, disabled when 0")
+	adminHostFlag := flag.String("admin-host", "127.0.0.1", "listening address of the admin API, which isn't authenticated")
+	reloadIntervalFlag := flag.Duration("reload-interval", 2*time.Second, "interval at which the server list is checked for changes, disabled when 0")
+	gracePeriodFlag := flag.Duration("grace-period", 30*time.Second, "how long requests in flight are waited for on shutdown")
 	flag.Parse()
 
-	pool, err := lb.NewLoadBalancer(originServerList, *portFlag)
-	if err != nil {
-		panic(err)
+	// SIGTERM or SIGINT stops the load balancer
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	// the config either describes a single pool or several pools routed by host
+	var balancer interface {
+		http.Handler
+		Close() error
+	}
+	var watcher *lb.ConfigWatcher
+	var admin *http.Server
+	if lb.IsRouterConfig(data) {
+		cfg, err := lb.ParseRouterConfig(data)
+		if err != nil {
+			panic(err)
+		}
+
+		router, err := lb.NewRouter(ctx, cfg)
+		if err != nil {
+			panic(err)
+		}
+
+		balancer = router
+		watcher = lb.NewRouterConfigWatcher(router, configPath, *reloadIntervalFlag)
+		if *adminPortFlag != 0 {
+			admin = lb.NewRouterAdminServer(router, *adminPortFlag)
+		}
+	} else {
+		cfg, err := lb.ParseConfig(data)
+		if err != nil {
+			panic(err)
+		}
+
+		opts, err := cfg.Options()
+		if err != nil {
+			panic(err)
+		}
+
+		serverPool, err := lb.New(ctx, cfg.Servers, opts...)
+		if err != nil {
+			panic(err)
+		}
+
+		balancer = serverPool
+		watcher = lb.NewConfigWatcher(serverPool, configPath, *reloadIntervalFlag)
+		if *adminPortFlag != 0 {
+			admin = lb.NewAdminServer(serverPool, *adminPortFlag)
+		}
+	}
+
+	pool := &http.Server{
+		Addr:    fmt.Sprintf(":%d", *portFlag),
+		Handler: balancer,
 	}
 
+	// reload the server list when it changes and on SIGHUP
+	if *reloadIntervalFlag > 0 {
+		go watcher.Run()
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Default().Printf("Reloading %s ...", configPath)
+			watcher.Reload()
+		}
+	}()
+
+	servers := []*http.Server{pool}
+	if admin != nil {
+		admin.Addr = net.JoinHostPort(*adminHostFlag, strconv.Itoa(*adminPortFlag))
+		servers = append(servers, admin)
+		go func() {
+			log.Default().Printf("Starting admin server on %s ...", admin.Addr)
+			if err := admin.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	// on SIGTERM or SIGINT, stop accepting connections and wait for the requests in flight
+	shutdown := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		// restore the default behaviour so that a second signal exits right away
+		stop()
+
+		log.Default().Printf("Shutting down, waiting up to %s for requests in flight (send the signal again to force exit) ...", *gracePeriodFlag)
+		ctx, cancel := context.WithTimeout(context.Background(), *gracePeriodFlag)
+		defer cancel()
+
+		for _, srv := range servers {
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Default().Printf("Shutdown: %s", err)
+			}
+		}
+		close(shutdown)
+	}()
+
 	log.Default().Printf("Starting server on port %d ...", *portFlag)
-	log.Fatal(pool.ListenAndServe())
+	if err := pool.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+
+	<-shutdown
+	balancer.Close()
+	log.Default().Println("Server stopped")
 }